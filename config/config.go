@@ -3,23 +3,97 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+
+	"github.com/blavejr/bowattAI/models"
 )
 
 type Config struct {
 	MongoURI        string
 	MongoDatabase   string
 	MongoCollection string
+	// conversation sessions with their message history
+	MongoConversationsCollection string
+	// cached map-reduce summaries, one document per summarized section
+	MongoSummariesCollection string
+	// one document per book, written at upload
+	MongoBooksCollection string
+
+	// backend for embeddings and generation: "ollama" or "openai" (any OpenAI-compatible server)
+	EmbeddingProvider string
+	LLMProvider       string
 
 	OllamaURL        string // "http://localhost:11434"
 	OllamaEmbedModel string
 	OllamaLLMModel   string
 
+	OpenAIBaseURL    string // "http://localhost:8000", llama.cpp / vLLM
+	OpenAIAPIKey     string
+	OpenAIEmbedModel string
+	OpenAILLMModel   string
+
+	// default sampling options and the extra models a query may switch to
+	LLMOptions      models.GenerationOptions
+	LLMModelAllowed []string
+
+	// refuse to start when stored chunks were embedded with a different model
+	EmbeddingStrict bool
+	// per-model prefix templates for instruction-tuned embedders, keyed by model name
+	EmbeddingPrefixes map[string]EmbeddingPrefix
+
 	Port        string
 	Environment string
 
 	ChunkSize    int
 	ChunkOverlap int
 	TopK         int
+
+	// approximate tokens of conversation history passed to the generator
+	HistoryTokenBudget int
+	// approximate tokens of retrieved passages passed to the generator, 0 for no limit
+	ContextTokenBudget int
+	// approximate tokens of text summarized per LLM call in the map and reduce steps
+	SummaryTokenBudget int
+	// old versions of a book kept alongside the current one, 0 keeps every version until deleted
+	KeepBookVersions int
+	// minutes after which an unfinished upload is cleaned up, at startup and by a sweep every 5 minutes
+	PendingUploadTimeout int
+	// largest file accepted for upload, 0 for no limit
+	MaxUploadMB int
+	// chunks embedded and inserted together while ingesting, bounds the memory an upload uses
+	IngestBatchSize int
+	// let the LLM classify questions the query routing rules don't recognise
+	RouteWithLLM bool
+	// default query expansion ("", "hyde" or "multi_query") and the paraphrases multi-query searches with
+	QueryExpansion      string
+	QueryExpansionCount int
+
+	// check answers against the retrieved passages, optionally with an LLM entailment prompt
+	VerifyAnswers bool
+	VerifyWithLLM bool
+	// refuse answers whose grounded score is below GroundedThreshold
+	VerifyStrict      bool
+	GroundedThreshold float64
+
+	// directory of *.tmpl prompt templates and the one used when none is selected
+	PromptTemplatesDir    string
+	DefaultPromptTemplate string
+}
+
+// EmbeddingPrefix holds the templates applied to text before embedding it
+// a template may contain {text}, otherwise it is used as a prefix
+type EmbeddingPrefix struct {
+	Query    string
+	Document string
+}
+
+// prefixes for known asymmetric retrieval models
+var defaultEmbeddingPrefixes = map[string]EmbeddingPrefix{
+	"nomic-embed-text":  {Query: "search_query: ", Document: "search_document: "},
+	"mxbai-embed-large": {Query: "Represent this sentence for searching relevant passages: "},
+	"snowflake-arctic-embed": {
+		Query: "Represent this sentence for searching relevant passages: ",
+	},
 }
 
 func Load() *Config {
@@ -42,16 +116,104 @@ func Load() *Config {
 		return value
 	}
 
+	// unset or invalid values leave the option to the model
+	getEnvIntPtr := func(key string) *int {
+		value, err := strconv.Atoi(os.Getenv(key))
+		if err != nil {
+			return nil
+		}
+		return &value
+	}
+
+	getEnvFloatPtr := func(key string) *float64 {
+		value, err := strconv.ParseFloat(os.Getenv(key), 64)
+		if err != nil {
+			return nil
+		}
+		return &value
+	}
+
+	getEnvList := func(key, sep string) []string {
+		var values []string
+		for _, value := range strings.Split(os.Getenv(key), sep) {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+
+	getEnvFloat := func(key string, defaultValue float64) float64 {
+		if value := getEnvFloatPtr(key); value != nil {
+			return *value
+		}
+		return defaultValue
+	}
+
+	getEnvBool := func(key string, defaultValue bool) bool {
+		valueStr := os.Getenv(key)
+		if valueStr == "" {
+			return defaultValue
+		}
+		value, err := strconv.ParseBool(valueStr)
+		if err != nil {
+			return defaultValue
+		}
+		return value
+	}
+
+	// EMBEDDING_QUERY_PREFIXES / EMBEDDING_DOCUMENT_PREFIXES: "model=template;model=template"
+	embeddingPrefixes := make(map[string]EmbeddingPrefix, len(defaultEmbeddingPrefixes))
+	for model, prefix := range defaultEmbeddingPrefixes {
+		embeddingPrefixes[model] = prefix
+	}
+	for model, template := range parseModelTemplates(os.Getenv("EMBEDDING_QUERY_PREFIXES")) {
+		prefix := embeddingPrefixes[model]
+		prefix.Query = template
+		embeddingPrefixes[model] = prefix
+	}
+	for model, template := range parseModelTemplates(os.Getenv("EMBEDDING_DOCUMENT_PREFIXES")) {
+		prefix := embeddingPrefixes[model]
+		prefix.Document = template
+		embeddingPrefixes[model] = prefix
+	}
+
 	return &Config{
 		MongoURI:        getEnv("MONGO_URI", "mongodb://localhost:27017"),
 		MongoDatabase:   getEnv("MONGO_DATABASE", "rag_db"),
 		MongoCollection: getEnv("MONGO_COLLECTION", "chunks"),
 
+		MongoConversationsCollection: getEnv("MONGO_CONVERSATIONS_COLLECTION", "conversations"),
+		MongoSummariesCollection:     getEnv("MONGO_SUMMARIES_COLLECTION", "summaries"),
+		MongoBooksCollection:         getEnv("MONGO_BOOKS_COLLECTION", "books"),
+
+		EmbeddingProvider: getEnv("EMBEDDING_PROVIDER", "ollama"),
+		LLMProvider:       getEnv("LLM_PROVIDER", "ollama"),
+
 		// Ollama
 		OllamaURL:        getEnv("OLLAMA_URL", "http://localhost:11434"),
 		OllamaEmbedModel: getEnv("OLLAMA_EMBEDDING_MODEL", "simple"),
 		OllamaLLMModel:   getEnv("OLLAMA_LLM_MODEL", "llama3.2:3b"),
 
+		// OpenAI-compatible
+		OpenAIBaseURL:    getEnv("OPENAI_BASE_URL", "http://localhost:8000"),
+		OpenAIAPIKey:     getEnv("OPENAI_API_KEY", ""),
+		OpenAIEmbedModel: getEnv("OPENAI_EMBEDDING_MODEL", "simple"),
+		OpenAILLMModel:   getEnv("OPENAI_LLM_MODEL", "default"),
+
+		LLMOptions: models.GenerationOptions{
+			Temperature: getEnvFloatPtr("LLM_TEMPERATURE"),
+			TopP:        getEnvFloatPtr("LLM_TOP_P"),
+			NumCtx:      getEnvIntPtr("LLM_NUM_CTX"),
+			NumPredict:  getEnvIntPtr("LLM_NUM_PREDICT"),
+			Seed:        getEnvIntPtr("LLM_SEED"),
+			Stop:        getEnvList("LLM_STOP", "|"),
+		},
+		LLMModelAllowed: getEnvList("LLM_MODEL_ALLOWLIST", ","),
+
+		EmbeddingStrict:   getEnvBool("EMBEDDING_STRICT", false),
+		EmbeddingPrefixes: embeddingPrefixes,
+
 		// Application settings
 		Port:        getEnv("PORT", "8080"),
 		Environment: getEnv("ENVIRONMENT", "development"),
@@ -60,5 +222,70 @@ func Load() *Config {
 		ChunkSize:    getEnvInt("CHUNK_SIZE", 500),
 		ChunkOverlap: getEnvInt("CHUNK_OVERLAP", 50),
 		TopK:         getEnvInt("TOP_K", 5),
+
+		HistoryTokenBudget: getEnvInt("HISTORY_TOKEN_BUDGET", 1000),
+		ContextTokenBudget: getEnvInt("CONTEXT_TOKEN_BUDGET", 1500),
+		SummaryTokenBudget: getEnvInt("SUMMARY_TOKEN_BUDGET", 2000),
+		KeepBookVersions:   getEnvInt("KEEP_BOOK_VERSIONS", 0),
+		RouteWithLLM:       getEnvBool("ROUTE_WITH_LLM", false),
+
+		PendingUploadTimeout: getEnvInt("PENDING_UPLOAD_TIMEOUT", 60),
+		MaxUploadMB:          getEnvInt("MAX_UPLOAD_MB", 512),
+		IngestBatchSize:      getEnvInt("INGEST_BATCH_SIZE", 64),
+
+		QueryExpansion:      getEnv("QUERY_EXPANSION", ""),
+		QueryExpansionCount: getEnvInt("QUERY_EXPANSION_COUNT", 3),
+
+		VerifyAnswers:     getEnvBool("VERIFY_ANSWERS", true),
+		VerifyWithLLM:     getEnvBool("VERIFY_WITH_LLM", false),
+		VerifyStrict:      getEnvBool("VERIFY_STRICT", false),
+		GroundedThreshold: getEnvFloat("GROUNDED_THRESHOLD", 0.5),
+
+		PromptTemplatesDir:    getEnv("PROMPT_TEMPLATES_DIR", "templates"),
+		DefaultPromptTemplate: getEnv("PROMPT_TEMPLATE", "default"),
+	}
+}
+
+// the embedding model of the configured provider
+func (c *Config) EmbeddingModel() string {
+	if c.EmbeddingProvider == "openai" {
+		return c.OpenAIEmbedModel
+	}
+	return c.OllamaEmbedModel
+}
+
+// the generation model of the configured provider
+func (c *Config) LLMModel() string {
+	if c.LLMProvider == "openai" {
+		return c.OpenAILLMModel
+	}
+	return c.OllamaLLMModel
+}
+
+// whether a query may generate with this model, the configured one is always allowed
+func (c *Config) IsLLMModelAllowed(model string) bool {
+	if model == c.LLMModel() {
+		return true
+	}
+	for _, allowed := range c.LLMModelAllowed {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// parse "model=template;model=template" into a map
+// templates keep their surrounding whitespace since prefixes usually end in a space
+func parseModelTemplates(value string) map[string]string {
+	templates := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		model, template, ok := strings.Cut(entry, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			continue
+		}
+		templates[model] = template
 	}
+	return templates
 }
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/storage"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultChunkPageSize = 20
+	maxChunkPageSize     = 100
+	maxChunkNeighbours   = 5
+)
+
+// ListChunks pages through a book's chunks as stored, for checking chunking and metadata
+func (rc *RAGController) ListChunks(c *gin.Context) {
+	bookID := c.Param("id")
+
+	var req models.ListChunksRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultChunkPageSize
+	}
+	if req.Limit < 0 || req.Limit > maxChunkPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxChunkPageSize)})
+		return
+	}
+	after := -1
+	if req.After != nil {
+		after = *req.After
+	}
+
+	ctx := context.Background()
+	book, err := rc.store.GetBook(ctx, bookID)
+	if err != nil {
+		log.Printf("Failed to get book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	if book == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+	if req.Version < 0 || (req.Version > 0 && !hasVersion(book, req.Version)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+
+	chunks, total, err := rc.store.ListChunks(ctx, bookID, storage.ChunkQuery{
+		After:      after,
+		Limit:      req.Limit,
+		Text:       req.Text,
+		Embeddings: req.Embeddings,
+		Version:    req.Version,
+	})
+	if err != nil {
+		log.Printf("Failed to list chunks of book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
+		return
+	}
+
+	page := models.ChunkPage{
+		BookID: bookID,
+		Chunks: chunkViews(chunks),
+		Total:  total,
+		Limit:  req.Limit,
+	}
+	// a full page may have more after it
+	if len(chunks) == req.Limit {
+		last := chunks[len(chunks)-1].ChunkIndex
+		page.NextAfter = &last
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// GetChunk returns a single chunk with the chunks around it
+func (rc *RAGController) GetChunk(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chunk ID"})
+		return
+	}
+
+	var req models.GetChunkRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	neighbours := 1
+	if req.Neighbours != nil {
+		neighbours = *req.Neighbours
+	}
+	if neighbours < 0 || neighbours > maxChunkNeighbours {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("neighbours must be between 0 and %d", maxChunkNeighbours)})
+		return
+	}
+
+	ctx := context.Background()
+	chunk, err := rc.store.GetChunk(ctx, id, req.Embeddings)
+	if err != nil {
+		log.Printf("Failed to get chunk %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunk"})
+		return
+	}
+	if chunk == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chunk not found"})
+		return
+	}
+
+	previous, next, err := rc.store.GetNeighbourChunks(ctx, chunk, neighbours, req.Embeddings)
+	if err != nil {
+		log.Printf("Failed to get neighbours of chunk %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunk"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ChunkDetail{
+		Chunk:    models.NewChunkView(*chunk),
+		Previous: chunkViews(previous),
+		Next:     chunkViews(next),
+	})
+}
+
+func chunkViews(chunks []models.Chunk) []models.ChunkView {
+	views := make([]models.ChunkView, len(chunks))
+	for i, chunk := range chunks {
+		views[i] = models.NewChunkView(chunk)
+	}
+	return views
+}
@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// max characters of the first question used as a conversation title
+const maxConversationTitle = 60
+
+func (rc *RAGController) CreateConversation(c *gin.Context) {
+	var req models.CreateConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "book_id is required"})
+		return
+	}
+
+	conversation := &models.Conversation{
+		BookID: req.BookID,
+		Title:  req.Title,
+	}
+	if err := rc.store.CreateConversation(context.Background(), conversation); err != nil {
+		log.Printf("Failed to create conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+
+	log.Printf("Created conversation %s for book %s", conversation.ID.Hex(), req.BookID)
+	c.JSON(http.StatusCreated, conversation)
+}
+
+func (rc *RAGController) ListConversations(c *gin.Context) {
+	conversations, err := rc.store.ListConversations(context.Background(), c.Query("book_id"))
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversations"})
+		return
+	}
+
+	if conversations == nil {
+		conversations = []models.Conversation{}
+	}
+	c.JSON(http.StatusOK, conversations)
+}
+
+func (rc *RAGController) GetConversation(c *gin.Context) {
+	id, ok := conversationID(c)
+	if !ok {
+		return
+	}
+
+	conversation, err := rc.store.GetConversation(context.Background(), id)
+	if err != nil {
+		log.Printf("Failed to get conversation %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		return
+	}
+	if conversation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, conversation)
+}
+
+func (rc *RAGController) RenameConversation(c *gin.Context) {
+	id, ok := conversationID(c)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+		return
+	}
+
+	found, err := rc.store.RenameConversation(context.Background(), id, req.Title)
+	if err != nil {
+		log.Printf("Failed to rename conversation %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename conversation"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id.Hex(), "title": req.Title})
+}
+
+func (rc *RAGController) DeleteConversation(c *gin.Context) {
+	id, ok := conversationID(c)
+	if !ok {
+		return
+	}
+
+	found, err := rc.store.DeleteConversation(context.Background(), id)
+	if err != nil {
+		log.Printf("Failed to delete conversation %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete conversation"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SendMessage answers a question in the context of a conversation
+// the question is rewritten into a standalone one for retrieval and the history is passed to the generator
+func (rc *RAGController) SendMessage(c *gin.Context) {
+	startTime := time.Now()
+
+	id, ok := conversationID(c)
+	if !ok {
+		return
+	}
+
+	var req models.ConversationMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if req.PromptTemplate != "" && !rc.generator.Templates.Has(req.PromptTemplate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt template"})
+		return
+	}
+
+	if err := rc.validateGeneration(req.Model, req.Options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	conversation, err := rc.store.GetConversation(ctx, id)
+	if err != nil {
+		log.Printf("Failed to get conversation %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		return
+	}
+	if conversation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	topK := req.TopK
+	if topK <= 0 {
+		topK = rc.config.TopK
+	}
+
+	history := services.TrimHistory(conversation.Messages, rc.config.HistoryTokenBudget)
+	standalone := rc.generator.RewriteQuestion(req.Question, history)
+	log.Printf("Conversation %s: '%s' -> '%s' (history: %d/%d messages)", id.Hex(), req.Question, standalone, len(history), len(conversation.Messages))
+
+	results, err := rc.retriever.Retrieve(ctx, standalone, topK, conversation.BookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
+		return
+	}
+
+	if len(results) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No relevant chunks found"})
+		return
+	}
+	results, dropped := rc.packContexts(results)
+
+	genReq := services.GenerateRequest{
+		Question: req.Question,
+		Contexts: services.ContextsFromResults(results),
+		History:  history,
+		Template: rc.promptTemplate(req.PromptTemplate, results),
+		Model:    req.Model,
+		Options:  req.Options,
+	}
+	answer, err := rc.generator.Generate(ctx, genReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate response"})
+		return
+	}
+
+	answer, verification, refused := rc.verifyAnswer(ctx, answer, genReq.Contexts, req.Strict, req.VerifyWithLLM)
+
+	sources := buildSources(results)
+	segments, citations := services.ParseCitations(answer, sourceIDs(sources))
+	now := time.Now()
+	userMessage := models.Message{
+		Role:      "user",
+		Content:   req.Question,
+		CreatedAt: now,
+	}
+	if standalone != req.Question {
+		userMessage.StandaloneQuestion = standalone
+	}
+	assistantMessage := models.Message{
+		Role:      "assistant",
+		Content:   answer,
+		Sources:   sources,
+		CreatedAt: now,
+	}
+	if err := rc.store.AppendMessages(ctx, id, userMessage, assistantMessage); err != nil {
+		log.Printf("Failed to save messages for conversation %s: %v", id.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save messages"})
+		return
+	}
+
+	// name untitled conversations after their first question
+	if conversation.Title == "" {
+		title := []rune(req.Question)
+		if len(title) > maxConversationTitle {
+			title = append(title[:maxConversationTitle], '…')
+		}
+		if _, err := rc.store.RenameConversation(ctx, id, string(title)); err != nil {
+			log.Printf("Failed to set title for conversation %s: %v", id.Hex(), err)
+		}
+	}
+
+	processingTime := time.Since(startTime)
+	log.Printf("Conversation %s answered in %v", id.Hex(), processingTime)
+	model, options := rc.generator.Resolve(genReq)
+
+	response := models.ConversationMessageResponse{
+		ConversationID:     id.Hex(),
+		Answer:             answer,
+		StandaloneQuestion: standalone,
+		Segments:           segments,
+		Citations:          citations,
+		Sources:            sources,
+		DroppedSources:     buildSources(dropped),
+		ProcessingTimeMs:   processingTime.Milliseconds(),
+		Model:              model,
+		Options:            options,
+		Refused:            refused,
+	}
+	if verification != nil {
+		response.GroundedScore = &verification.GroundedScore
+		response.UnsupportedSentences = verification.UnsupportedSentences
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// parse the :id route parameter, writing a 400 if it isn't a valid ID
+func conversationID(c *gin.Context) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/services"
+	"github.com/blavejr/bowattAI/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// answer a question about the book itself from its stored details, without the LLM
+func (rc *RAGController) queryMetadata(c *gin.Context, req models.QueryRequest, decision services.RouteDecision, startTime time.Time) {
+	book, err := rc.store.GetBook(context.Background(), req.BookID)
+	if err != nil {
+		log.Printf("Failed to get book %s: %v", req.BookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	if book == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.QueryResponse{
+		Answer:           services.AnswerMetadata(req.Question, book),
+		Segments:         []models.AnswerSegment{},
+		Citations:        []models.Citation{},
+		Sources:          []models.SourceChunk{},
+		DroppedSources:   []models.SourceChunk{},
+		ProcessingTimeMs: time.Since(startTime).Milliseconds(),
+		Route:            services.RouteMetadata,
+		RouteReason:      decision.Reason,
+	})
+}
+
+// answer a question from a summary of the book or of the chapters it mentions
+// falls back to retrieval when the chapters can't be found
+func (rc *RAGController) querySummary(c *gin.Context, req models.QueryRequest, decision services.RouteDecision, startTime time.Time) {
+	ctx := context.Background()
+	summary, err := rc.summarizer.Summarize(ctx, req.BookID, models.SummarizeRequest{
+		ChapterFrom: decision.ChapterFrom,
+		ChapterTo:   decision.ChapterTo,
+	})
+	if errors.Is(err, services.ErrNoChunks) {
+		if decision.ChapterFrom == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		decision.Reason += ", chapters not found so answered by retrieval"
+		rc.queryRetrieval(c, req, decision, startTime)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to summarize book %s: %v", req.BookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize book"})
+		return
+	}
+
+	genReq := services.GenerateRequest{
+		Question: req.Question,
+		Contexts: []services.PromptContext{{Number: 1, Text: summary.Summary, Chapter: decision.ChapterFrom}},
+		Template: rc.promptTemplate(req.PromptTemplate, nil),
+		Model:    req.Model,
+		Options:  req.Options,
+	}
+	answer, err := rc.generator.Generate(ctx, genReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate response"})
+		return
+	}
+
+	answer, verification, refused := rc.verifyAnswer(ctx, answer, genReq.Contexts, req.Strict, req.VerifyWithLLM)
+
+	processingTime := time.Since(startTime)
+	log.Printf("Query answered from summary in %v", processingTime)
+	model, options := rc.generator.Resolve(genReq)
+
+	// the answer cites the summary rather than chunks, so there are no sources to link
+	response := models.QueryResponse{
+		Answer:           answer,
+		Segments:         []models.AnswerSegment{},
+		Citations:        []models.Citation{},
+		Sources:          []models.SourceChunk{},
+		DroppedSources:   []models.SourceChunk{},
+		ProcessingTimeMs: processingTime.Milliseconds(),
+		Model:            model,
+		Options:          options,
+		Refused:          refused,
+		Route:            services.RouteSummary,
+		RouteReason:      decision.Reason,
+		Summary:          summary.Summary,
+	}
+	if verification != nil {
+		response.GroundedScore = &verification.GroundedScore
+		response.UnsupportedSentences = verification.UnsupportedSentences
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// answer a question that needs evidence from several places
+// the question is split into sub-questions, evidence is retrieved for each and the merged passages answer the original
+func (rc *RAGController) queryMultiHop(c *gin.Context, req models.QueryRequest, decision services.RouteDecision, startTime time.Time) {
+	topK := req.TopK
+	if topK <= 0 {
+		topK = rc.config.TopK
+	}
+
+	ctx := context.Background()
+	decomposition, err := rc.decomposer.Gather(ctx, req.Question, topK, req.BookID, req.Filter)
+	if err != nil {
+		log.Printf("Failed to gather evidence: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
+		return
+	}
+
+	if len(decomposition.Results) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No relevant chunks found"})
+		return
+	}
+	// keep the round-robin order so every sub-question contributes evidence
+	results, dropped := services.PackContextsInOrder(decomposition.Results, rc.config.ContextTokenBudget)
+	if len(dropped) > 0 {
+		log.Printf("Context budget of %d tokens: using %d passages, dropped %d", rc.config.ContextTokenBudget, len(results), len(dropped))
+	}
+
+	genReq := services.GenerateRequest{
+		Question: req.Question,
+		Contexts: services.ContextsFromResults(results),
+		Template: rc.promptTemplate(req.PromptTemplate, results),
+		Model:    req.Model,
+		Options:  req.Options,
+	}
+	answer, err := rc.generator.Generate(ctx, genReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate response"})
+		return
+	}
+
+	answer, verification, refused := rc.verifyAnswer(ctx, answer, genReq.Contexts, req.Strict, req.VerifyWithLLM)
+
+	sources := buildSources(results)
+	segments, citations := services.ParseCitations(answer, sourceIDs(sources))
+
+	processingTime := time.Since(startTime)
+	log.Printf("Multi-hop query answered in %v (%d sub-questions)", processingTime, len(decomposition.Steps))
+	model, options := rc.generator.Resolve(genReq)
+
+	response := models.QueryResponse{
+		Answer:           answer,
+		Segments:         segments,
+		Citations:        citations,
+		Sources:          sources,
+		DroppedSources:   buildSources(dropped),
+		ProcessingTimeMs: processingTime.Milliseconds(),
+		Model:            model,
+		Options:          options,
+		Refused:          refused,
+		Route:            services.RouteMultiHop,
+		RouteReason:      decision.Reason,
+		Steps:            decomposition.Steps,
+	}
+	if verification != nil {
+		response.GroundedScore = &verification.GroundedScore
+		response.UnsupportedSentences = verification.UnsupportedSentences
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// answer a question from chunks of several books, or the whole library
+// sources are also returned grouped by book
+func (rc *RAGController) queryLibrary(c *gin.Context, req models.QueryRequest, startTime time.Time) {
+	topK := req.TopK
+	if topK <= 0 {
+		topK = rc.config.TopK
+	}
+
+	filter := storage.LibraryFilter{
+		BookIDs: req.BookIDs,
+		Tags:    services.NormalizeTags(req.Tags),
+		Author:  strings.TrimSpace(req.Author),
+		Chunks:  req.Filter,
+	}
+	log.Printf("Library query: '%s' (book_ids: %v, tags: %v, author: %q, top-k: %d)", req.Question, req.BookIDs, req.Tags, req.Author, topK)
+
+	ctx := context.Background()
+	results, err := rc.retriever.RetrieveLibrary(ctx, req.Question, topK, filter)
+	if err != nil {
+		log.Printf("Failed to retrieve across books: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
+		return
+	}
+
+	if len(results) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No relevant chunks found"})
+		return
+	}
+
+	// keep the normalised ranking rather than re-sorting by raw score
+	results, dropped := services.PackContextsInOrder(results, rc.config.ContextTokenBudget)
+
+	genReq := services.GenerateRequest{
+		Question:  req.Question,
+		Contexts:  services.ContextsFromResults(results),
+		Template:  rc.promptTemplate(req.PromptTemplate, nil),
+		Model:     req.Model,
+		Options:   req.Options,
+		CrossBook: true,
+	}
+	answer, err := rc.generator.Generate(ctx, genReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate response"})
+		return
+	}
+
+	answer, verification, refused := rc.verifyAnswer(ctx, answer, genReq.Contexts, req.Strict, req.VerifyWithLLM)
+
+	sources := buildSources(results)
+	segments, citations := services.ParseCitations(answer, sourceIDs(sources))
+
+	processingTime := time.Since(startTime)
+	log.Printf("Library query answered in %v", processingTime)
+	model, options := rc.generator.Resolve(genReq)
+
+	response := models.QueryResponse{
+		Answer:           answer,
+		Segments:         segments,
+		Citations:        citations,
+		Sources:          sources,
+		DroppedSources:   buildSources(dropped),
+		ProcessingTimeMs: processingTime.Milliseconds(),
+		Model:            model,
+		Options:          options,
+		Refused:          refused,
+		Route:            services.RouteRetrieval,
+		RouteReason:      "searched across books",
+		SourceGroups:     groupSources(sources),
+	}
+	if verification != nil {
+		response.GroundedScore = &verification.GroundedScore
+		response.UnsupportedSentences = verification.UnsupportedSentences
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// group sources by book, books in order of their best source
+func groupSources(sources []models.SourceChunk) []models.BookSources {
+	var groups []models.BookSources
+	index := make(map[string]int)
+	for _, source := range sources {
+		i, ok := index[source.BookID]
+		if !ok {
+			i = len(groups)
+			index[source.BookID] = i
+			groups = append(groups, models.BookSources{
+				BookID: source.BookID,
+				Title:  source.Metadata.BookTitle,
+				Author: source.Metadata.BookAuthor,
+			})
+		}
+		groups[i].Sources = append(groups[i].Sources, source)
+	}
+	return groups
+}
@@ -2,9 +2,14 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/blavejr/bowattAI/config"
@@ -13,43 +18,64 @@ import (
 	"github.com/blavejr/bowattAI/storage"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// longest summary a request may ask for, in words
+const maxSummaryWords = 2000
+
 type RAGController struct {
-	config    *config.Config
-	store     *storage.MongoStore
-	chunker   *services.Chunker
-	embedder  *services.Embedder
-	generator *services.Generator
-	retriever *services.Retriever
+	config     *config.Config
+	store      *storage.MongoStore
+	chunker    *services.Chunker
+	embedder   *services.Embedder
+	generator  *services.Generator
+	retriever  *services.Retriever
+	reindexer  *services.Reindexer
+	verifier   *services.Verifier
+	summarizer *services.Summarizer
+	router     *services.Router
+	decomposer *services.Decomposer
+	versioner  *services.Versioner
+	ingester   *services.Ingester
 }
 
-func NewRAGController(cfg *config.Config, store *storage.MongoStore) *RAGController {
+func NewRAGController(cfg *config.Config, store *storage.MongoStore, templates *services.PromptTemplates) *RAGController {
 	chunker := services.NewChunker(cfg.ChunkSize, cfg.ChunkOverlap)
-	embedder := services.NewEmbedder(cfg.OllamaURL, cfg.OllamaEmbedModel)
-	generator := services.NewGenerator(cfg.OllamaURL, cfg.OllamaLLMModel)
-	retriever := services.NewRetriever(store, embedder)
+	embedder := services.NewEmbedder(services.NewEmbeddingProvider(cfg), cfg.EmbeddingModel(), cfg.EmbeddingPrefixes)
+	generator := services.NewGenerator(services.NewChatProvider(cfg), cfg.LLMModel(), cfg.LLMOptions, templates)
+	retriever := services.NewRetriever(store, embedder, generator)
+	reindexer := services.NewReindexer(store, embedder)
+
+	if !services.IsExpansion(cfg.QueryExpansion) {
+		log.Fatalf("Unknown QUERY_EXPANSION %q (expected none, hyde or multi_query)", cfg.QueryExpansion)
+	}
 
 	if err := embedder.TestConnection(); err != nil {
-		log.Printf("Warning: Ollama embedder connection test failed: %v", err)
+		log.Printf("Warning: embedder connection test failed: %v", err)
 	} else {
-		log.Println("Connected to Ollama embeddings")
+		log.Printf("Connected to %s embeddings", cfg.EmbeddingProvider)
 	}
 
 	if err := generator.TestConnection(); err != nil {
-		log.Printf("Warning: Ollama generator connection test failed: %v", err)
+		log.Printf("Warning: generator connection test failed: %v", err)
 	} else {
-		log.Println("Connected to Ollama LLM")
+		log.Printf("Connected to %s LLM", cfg.LLMProvider)
 	}
 
 	return &RAGController{
-		config:    cfg,
-		store:     store,
-		chunker:   chunker,
-		embedder:  embedder,
-		generator: generator,
-		retriever: retriever,
+		config:     cfg,
+		store:      store,
+		chunker:    chunker,
+		embedder:   embedder,
+		generator:  generator,
+		retriever:  retriever,
+		reindexer:  reindexer,
+		verifier:   services.NewVerifier(generator),
+		summarizer: services.NewSummarizer(store, generator, cfg.SummaryTokenBudget),
+		versioner:  services.NewVersioner(store, chunker, embedder, cfg.IngestBatchSize),
+		ingester:   services.NewIngester(store, chunker, embedder, cfg.IngestBatchSize),
+		router:     services.NewRouter(generator),
+		decomposer: services.NewDecomposer(generator, retriever),
 	}
 }
 
@@ -57,122 +83,361 @@ func (rc *RAGController) UploadBook(c *gin.Context) {
 	startTime := time.Now()
 	log.Printf("Starting book upload process...")
 
+	rc.limitUpload(c)
+
 	var req models.UploadBookRequest
 	if err := c.ShouldBind(&req); err != nil {
+		if uploadTooLarge(err) {
+			rc.rejectTooLarge(c)
+			return
+		}
 		log.Printf("Invalid request - %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 	log.Printf("Form data parsed - Title: %s, Author: %s", req.Title, req.Author)
 
+	// upload again even if the same text was uploaded before
+	force, err := strconv.ParseBool(c.DefaultQuery("force", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "force must be true or false"})
+		return
+	}
+
+	if req.PromptTemplate != "" && !rc.generator.Templates.Has(req.PromptTemplate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt template"})
+		return
+	}
+
+	file, ok := rc.uploadedFile(c)
+	if !ok {
+		return
+	}
+
+	// the file is read twice, once to check for duplicates before doing any work and once to ingest it
+	ctx := context.Background()
+	contentHash, ok := hashUploadedFile(c, file)
+	if !ok {
+		return
+	}
+	existing, err := rc.store.FindBookByContentHash(ctx, contentHash)
+	if err != nil {
+		log.Printf("Failed to check for duplicate book - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for duplicate book"})
+		return
+	}
+	originalBookID := ""
+	if existing != nil {
+		if !force {
+			rejectDuplicate(c, existing)
+			return
+		}
+		originalBookID = existing.ID
+		if existing.OriginalBookID != "" {
+			originalBookID = existing.OriginalBookID
+		}
+		log.Printf("Uploading again, linked to book %s", originalBookID)
+	}
+
+	src, ok := openUploadedFile(c, file)
+	if !ok {
+		return
+	}
+	defer src.Close() // close the file when done
+
+	log.Printf("Processing book: %s by %s (%d bytes)", req.Title, req.Author, file.Size)
+	book, stats, err := rc.ingester.Ingest(ctx, src, services.IngestRequest{
+		Title:          req.Title,
+		Author:         req.Author,
+		Tags:           services.NormalizeTags(strings.Split(req.Tags, ",")),
+		PromptTemplate: req.PromptTemplate,
+		ContentHash:    contentHash,
+		OriginalBookID: originalBookID,
+	})
+	if errors.Is(err, services.ErrEmptyText) {
+		log.Printf("File is empty after cleaning")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+		return
+	}
+	if errors.Is(err, storage.ErrDuplicateBook) {
+		// another upload of the same text got in between the check and the insert
+		existing, findErr := rc.store.FindBookByContentHash(ctx, contentHash)
+		if findErr != nil || existing == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "The same book is already being uploaded"})
+			return
+		}
+		rejectDuplicate(c, existing)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store book - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store book"})
+		return
+	}
+
+	processingTime := time.Since(startTime)
+	log.Printf("Book processed successfully: %s (ID: %s, %d chunks) in %v", book.Title, book.ID, book.TotalChunks, processingTime)
+	log.Printf("Performance breakdown - Chunking: %v, Embeddings: %v, DB: %v", stats.ChunkTime, stats.EmbedTime, stats.StoreTime)
+
+	c.JSON(http.StatusOK, models.UploadBookResponse{
+		BookID:           book.ID,
+		Title:            book.Title,
+		Author:           book.Author,
+		TotalChunks:      book.TotalChunks,
+		OriginalBookID:   originalBookID,
+		Version:          1,
+		EmbeddedChunks:   book.TotalChunks,
+		ProcessingTimeMs: processingTime.Milliseconds(),
+		Status:           "success",
+	})
+}
+
+func rejectDuplicate(c *gin.Context, existing *models.Book) {
+	log.Printf("Book already uploaded as %s (%s)", existing.ID, existing.Title)
+	c.JSON(http.StatusConflict, gin.H{
+		"error":   "Book already uploaded, add ?force=true to upload it again",
+		"book_id": existing.ID,
+		"book":    existing,
+	})
+}
+
+// cap the request body at MAX_UPLOAD_MB, with some room for the other form fields
+// the file itself is checked against the exact limit once the form is parsed
+func (rc *RAGController) limitUpload(c *gin.Context) {
+	if rc.config.MaxUploadMB <= 0 {
+		return
+	}
+	limit := int64(rc.config.MaxUploadMB)<<20 + 1<<20
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+}
+
+func (rc *RAGController) rejectTooLarge(c *gin.Context) {
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is larger than %d MB", rc.config.MaxUploadMB)})
+}
+
+func uploadTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// get the multipart "file" field, responding with an error if it is missing, empty or too large
+func (rc *RAGController) uploadedFile(c *gin.Context) (*multipart.FileHeader, bool) {
 	log.Printf("Getting uploaded file...")
 	file, err := c.FormFile("file")
 	if err != nil {
+		if uploadTooLarge(err) {
+			rc.rejectTooLarge(c)
+			return nil, false
+		}
 		log.Printf("No file uploaded - %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
-		return
+		return nil, false
 	}
 	log.Printf("File received - Name: %s, Size: %d bytes", file.Filename, file.Size)
 
-	log.Printf("Opening and reading file content...")
+	if rc.config.MaxUploadMB > 0 && file.Size > int64(rc.config.MaxUploadMB)<<20 {
+		rc.rejectTooLarge(c)
+		return nil, false
+	}
+	if file.Size == 0 {
+		log.Printf("File is empty")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+		return nil, false
+	}
+	return file, true
+}
+
+// open an uploaded file at the start of its text, after any markdown front matter, responding with an error if it can't be read
+func openUploadedFile(c *gin.Context, file *multipart.FileHeader) (multipart.File, bool) {
 	src, err := file.Open()
 	if err != nil {
 		log.Printf("Failed to open file - %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
-		return
+		return nil, false
 	}
-	defer src.Close() // close the file when done
 
-	content, err := io.ReadAll(src)
+	offset, err := services.FrontMatterLength(file.Filename, src)
 	if err != nil {
+		src.Close()
+		log.Printf("Failed to read front matter - %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid front matter"})
+		return nil, false
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		src.Close()
 		log.Printf("Failed to read file - %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return nil, false
+	}
+	return src, true
+}
+
+// hash the text of an uploaded file, responding with an error if it can't be read
+func hashUploadedFile(c *gin.Context, file *multipart.FileHeader) (string, bool) {
+	src, ok := openUploadedFile(c, file)
+	if !ok {
+		return "", false
+	}
+	defer src.Close()
+
+	contentHash, err := services.ContentHashReader(src)
+	if err != nil {
+		log.Printf("Failed to read file - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return "", false
+	}
+	return contentHash, true
+}
+
+func (rc *RAGController) QueryBook(c *gin.Context) {
+	startTime := time.Now()
+
+	var req models.QueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	text := string(content)
-	if len(text) == 0 {
-		log.Printf("File is empty")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+	// a single entry in book_ids is the same as book_id
+	if req.BookID == "" && len(req.BookIDs) == 1 && len(req.Tags) == 0 && req.Author == "" {
+		req.BookID = req.BookIDs[0]
+	}
+
+	if req.PromptTemplate != "" && !rc.generator.Templates.Has(req.PromptTemplate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt template"})
 		return
 	}
-	log.Printf("File read successfully - %d characters", len(text))
-	log.Printf("Processing book: %s by %s (%d characters)", req.Title, req.Author, len(text))
 
-	log.Printf("Splitting text into chunks...")
-	chunkStartTime := time.Now()
-	chunks := rc.chunker.ChunkText(text)
-	chunkTime := time.Since(chunkStartTime)
-	if len(chunks) == 0 {
-		log.Printf("Failed to chunk text")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to chunk text"})
+	if err := rc.validateGeneration(req.Model, req.Options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	log.Printf("Created %d chunks in %v", len(chunks), chunkTime)
 
-	log.Printf("Generating book ID...")
-	bookID := primitive.NewObjectID().Hex()
-	log.Printf("Book ID generated - %s", bookID)
+	if !services.IsExpansion(req.Expansion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown query expansion"})
+		return
+	}
 
-	log.Printf("Generating embeddings for %d chunks...", len(chunks))
-	embedStartTime := time.Now()
-	embeddings, err := rc.embedder.GenerateEmbeddingsBatch(chunks, 1)
-	embedTime := time.Since(embedStartTime)
-	if err != nil {
-		log.Printf("Failed to generate embeddings - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate embeddings"})
-		return
-	}
-	log.Printf("Generated %d embeddings in %v", len(embeddings), embedTime)
-
-	log.Printf("Creating chunk documents...")
-	docStartTime := time.Now()
-	chunkDocs := make([]models.Chunk, len(chunks))
-	for i, chunkText := range chunks {
-		chunkDocs[i] = models.Chunk{
-			ID:         primitive.NewObjectID(),
-			BookID:     bookID,
-			ChunkIndex: i,
-			Text:       chunkText,
-			Embedding:  embeddings[i], // The vector representation
-			Metadata: models.ChunkMetadata{
-				BookTitle:    req.Title,
-				BookAuthor:   req.Author,
-				CharacterEnd: len(chunkText),
-				ChunkSize:    len(chunkText),
-			},
-			CreatedAt: time.Now(),
+	if _, err := storage.ChunkFilterBSON(req.Filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid filter: %v", err)})
+		return
+	}
+
+	if req.Route != "" && !services.IsRoute(req.Route) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown route"})
+		return
+	}
+
+	// metadata, summaries and decomposition work on one book, library questions are answered from retrieval
+	if req.BookID == "" {
+		if req.Expansion != "" && req.Expansion != services.ExpansionNone {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Query expansion needs a single book_id"})
+			return
 		}
+		rc.queryLibrary(c, req, startTime)
+		return
+	}
+
+	ctx := context.Background()
+	decision := services.RouteDecision{Route: req.Route, Reason: "requested"}
+	if req.Route == "" {
+		decision = rc.router.Route(ctx, req.Question, req.RouteWithLLM || rc.config.RouteWithLLM)
+	} else if req.Route == services.RouteSummary {
+		decision.ChapterFrom, decision.ChapterTo = services.ChapterRange(req.Question)
+	}
+	log.Printf("Routing query to %s (%s)", decision.Route, decision.Reason)
+
+	// metadata and summary answers don't retrieve chunks, so a filter would be silently ignored
+	if req.Filter != nil && (decision.Route == services.RouteMetadata || decision.Route == services.RouteSummary) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("filter can't be applied to the %s route (%s), set route to retrieval", decision.Route, decision.Reason)})
+		return
+	}
+
+	switch decision.Route {
+	case services.RouteMetadata:
+		rc.queryMetadata(c, req, decision, startTime)
+	case services.RouteSummary:
+		rc.querySummary(c, req, decision, startTime)
+	case services.RouteMultiHop:
+		rc.queryMultiHop(c, req, decision, startTime)
+	default:
+		rc.queryRetrieval(c, req, decision, startTime)
+	}
+}
+
+// answer a question from the top-K retrieved chunks
+func (rc *RAGController) queryRetrieval(c *gin.Context, req models.QueryRequest, decision services.RouteDecision, startTime time.Time) {
+	topK := req.TopK
+	if topK <= 0 {
+		topK = rc.config.TopK
 	}
-	docTime := time.Since(docStartTime)
-	log.Printf("Created %d chunk documents in %v", len(chunkDocs), docTime)
 
-	log.Printf("Storing chunks in MongoDB...")
-	dbStartTime := time.Now()
+	log.Printf("Query: '%s' (book_id: %s, top-k: %d)", req.Question, req.BookID, topK)
+
 	ctx := context.Background()
-	if err := rc.store.InsertChunks(ctx, chunkDocs); err != nil {
-		log.Printf("Failed to store chunks - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunks"})
+	expansion := rc.expansion(req.Expansion)
+	results, expanded, err := rc.retriever.RetrieveExpanded(ctx, req.Question, topK, req.BookID, req.Filter, expansion, rc.config.QueryExpansionCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
 		return
 	}
-	dbTime := time.Since(dbStartTime)
-	log.Printf("Stored %d chunks in MongoDB in %v", len(chunkDocs), dbTime)
+
+	if len(results) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No relevant chunks found"})
+		return
+	}
+
+	log.Printf("Retrieved %d relevant chunks", len(results))
+	results, dropped := rc.packContexts(results)
+
+	genReq := services.GenerateRequest{
+		Question: req.Question,
+		Contexts: services.ContextsFromResults(results),
+		Template: rc.promptTemplate(req.PromptTemplate, results),
+		Model:    req.Model,
+		Options:  req.Options,
+	}
+	answer, err := rc.generator.Generate(ctx, genReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate response"})
+		return
+	}
+
+	answer, verification, refused := rc.verifyAnswer(ctx, answer, genReq.Contexts, req.Strict, req.VerifyWithLLM)
+
+	sources := buildSources(results)
+	segments, citations := services.ParseCitations(answer, sourceIDs(sources))
 
 	processingTime := time.Since(startTime)
-	log.Printf("Book processed successfully: %s (ID: %s) in %v", req.Title, bookID, processingTime)
-	log.Printf("Performance breakdown - Chunking: %v, Embeddings: %v, Docs: %v, DB: %v", chunkTime, embedTime, docTime, dbTime)
+	log.Printf("Query answered in %v", processingTime)
+	model, options := rc.generator.Resolve(genReq)
 
-	c.JSON(http.StatusOK, models.UploadBookResponse{
-		BookID:           bookID,
-		Title:            req.Title,
-		Author:           req.Author,
-		TotalChunks:      len(chunks),
+	response := models.QueryResponse{
+		Answer:           answer,
+		Segments:         segments,
+		Citations:        citations,
+		Sources:          sources,
+		DroppedSources:   buildSources(dropped),
 		ProcessingTimeMs: processingTime.Milliseconds(),
-		Status:           "success",
-	})
+		Model:            model,
+		Options:          options,
+		Refused:          refused,
+		Route:            services.RouteRetrieval,
+		RouteReason:      decision.Reason,
+		Expansion:        expansion,
+		ExpandedQueries:  expanded,
+	}
+	if verification != nil {
+		response.GroundedScore = &verification.GroundedScore
+		response.UnsupportedSentences = verification.UnsupportedSentences
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
-func (rc *RAGController) QueryBook(c *gin.Context) {
+// QueryBookStream answers a question over server-sent events
+// events: "sources" once, "token" per generated fragment, then "done" (or "error")
+func (rc *RAGController) QueryBookStream(c *gin.Context) {
 	startTime := time.Now()
 
 	var req models.QueryRequest
@@ -181,21 +446,48 @@ func (rc *RAGController) QueryBook(c *gin.Context) {
 		return
 	}
 
-	// validate book_id
 	if req.BookID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "book_id is required"})
 		return
 	}
 
+	if req.PromptTemplate != "" && !rc.generator.Templates.Has(req.PromptTemplate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt template"})
+		return
+	}
+
+	if err := rc.validateGeneration(req.Model, req.Options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !services.IsExpansion(req.Expansion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown query expansion"})
+		return
+	}
+
+	if _, err := storage.ChunkFilterBSON(req.Filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid filter: %v", err)})
+		return
+	}
+
+	// streamed tokens can't be taken back, so an answer can't be refused after the fact
+	if req.Strict {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "strict is not supported when streaming, use /api/query"})
+		return
+	}
+
 	topK := req.TopK
 	if topK <= 0 {
 		topK = rc.config.TopK
 	}
 
-	log.Printf("Query: '%s' (book_id: %s, top-k: %d)", req.Question, req.BookID, topK)
+	log.Printf("Streaming query: '%s' (book_id: %s, top-k: %d)", req.Question, req.BookID, topK)
 
-	ctx := context.Background()
-	results, err := rc.retriever.Retrieve(ctx, req.Question, topK, req.BookID)
+	// cancelled when the client disconnects, which aborts the upstream generation
+	ctx := c.Request.Context()
+	expansion := rc.expansion(req.Expansion)
+	results, expanded, err := rc.retriever.RetrieveExpanded(ctx, req.Question, topK, req.BookID, req.Filter, expansion, rc.config.QueryExpansionCount)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
 		return
@@ -205,38 +497,153 @@ func (rc *RAGController) QueryBook(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "No relevant chunks found"})
 		return
 	}
+	retrievalTime := time.Since(startTime)
+	results, dropped := rc.packContexts(results)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	sources := buildSources(results)
+	c.SSEvent("sources", sources)
+	c.Writer.Flush()
+
+	generationStart := time.Now()
+	genReq := services.GenerateRequest{
+		Question: req.Question,
+		Contexts: services.ContextsFromResults(results),
+		Template: rc.promptTemplate(req.PromptTemplate, results),
+		Model:    req.Model,
+		Options:  req.Options,
+	}
+	answer, err := rc.generator.GenerateStream(ctx, genReq, func(delta string) error {
+		c.SSEvent("token", gin.H{"delta": delta})
+		c.Writer.Flush()
+		return ctx.Err()
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Client disconnected, generation cancelled after %v", time.Since(generationStart))
+			return
+		}
+		log.Printf("Failed to stream response: %v", err)
+		c.SSEvent("error", gin.H{"error": "Failed to generate response"})
+		c.Writer.Flush()
+		return
+	}
 
-	log.Printf("Retrieved %d relevant chunks", len(results))
+	processingTime := time.Since(startTime)
+	log.Printf("Streamed answer in %v", processingTime)
+	model, options := rc.generator.Resolve(genReq)
 
-	contexts := make([]string, len(results))
-	for i, result := range results {
-		contexts[i] = result.Chunk.Text
+	segments, citations := services.ParseCitations(answer, sourceIDs(sources))
+	done := models.QueryStreamDone{
+		Answer:           answer,
+		Segments:         segments,
+		Citations:        citations,
+		DroppedSources:   buildSources(dropped),
+		RetrievalTimeMs:  retrievalTime.Milliseconds(),
+		GenerationTimeMs: time.Since(generationStart).Milliseconds(),
+		ProcessingTimeMs: processingTime.Milliseconds(),
+		Model:            model,
+		Options:          options,
+		Expansion:        expansion,
+		ExpandedQueries:  expanded,
+	}
+	// the answer has already been streamed, so only report the score, even if VERIFY_STRICT is set
+	if _, verification, _ := rc.verifyAnswer(ctx, answer, genReq.Contexts, false, req.VerifyWithLLM); verification != nil {
+		done.GroundedScore = &verification.GroundedScore
+		done.UnsupportedSentences = verification.UnsupportedSentences
 	}
 
-	answer, err := rc.generator.GenerateResponse(req.Question, contexts)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate response"})
-		return
+	c.SSEvent("done", done)
+	c.Writer.Flush()
+}
+
+// pick the requested prompt template, then the book's default, then the configured default
+func (rc *RAGController) promptTemplate(requested string, results []models.SearchResult) string {
+	if requested != "" {
+		return requested
+	}
+	if len(results) > 0 {
+		if name := results[0].Chunk.Metadata.PromptTemplate; name != "" && rc.generator.Templates.Has(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// the requested query expansion, or the configured default
+func (rc *RAGController) expansion(requested string) string {
+	if requested == "" {
+		return rc.config.QueryExpansion
+	}
+	return requested
+}
+
+// check a per-request model override against the allow-list and the generation options
+func (rc *RAGController) validateGeneration(model string, options models.GenerationOptions) error {
+	if model != "" && !rc.config.IsLLMModelAllowed(model) {
+		return fmt.Errorf("model %q is not allowed", model)
+	}
+	if err := services.ValidateOptions(options); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+// check an answer against its passages when verification is enabled
+// in strict mode an answer scoring below the threshold is replaced with a refusal
+func (rc *RAGController) verifyAnswer(ctx context.Context, answer string, contexts []services.PromptContext, strict, withLLM bool) (string, *services.Verification, bool) {
+	strict = strict || rc.config.VerifyStrict
+	withLLM = withLLM || rc.config.VerifyWithLLM
+	if !rc.config.VerifyAnswers && !strict && !withLLM {
+		return answer, nil, false
 	}
 
+	verification := rc.verifier.Verify(ctx, answer, contexts, withLLM)
+	log.Printf("Grounded score %.2f (%d claims, %d unsupported)", verification.GroundedScore, verification.Claims, len(verification.UnsupportedSentences))
+
+	if strict && verification.GroundedScore < rc.config.GroundedThreshold {
+		log.Printf("Refusing answer below grounded threshold %.2f", rc.config.GroundedThreshold)
+		return services.RefusalAnswer, &verification, true
+	}
+	return answer, &verification, false
+}
+
+// fit the retrieved passages into the generator's context budget
+func (rc *RAGController) packContexts(results []models.SearchResult) (packed, dropped []models.SearchResult) {
+	packed, dropped = services.PackContexts(results, rc.config.ContextTokenBudget)
+	if len(dropped) > 0 || (len(packed) > 0 && packed[len(packed)-1].Truncated) {
+		log.Printf("Context budget of %d tokens: using %d passages, dropped %d", rc.config.ContextTokenBudget, len(packed), len(dropped))
+	}
+	return packed, dropped
+}
+
+func buildSources(results []models.SearchResult) []models.SourceChunk {
 	sources := make([]models.SourceChunk, len(results))
 	for i, result := range results {
 		sources[i] = models.SourceChunk{
-			ChunkID:  result.Chunk.ID.Hex(),
-			Text:     result.Chunk.Text,
-			Score:    result.Score,
-			Metadata: result.Chunk.Metadata,
+			ChunkID:         result.Chunk.ID.Hex(),
+			BookID:          result.Chunk.BookID,
+			Text:            result.Chunk.Text,
+			Score:           result.Score,
+			NormalizedScore: result.NormalizedScore,
+			Truncated:       result.Truncated,
+			Metadata:        result.Chunk.Metadata,
 		}
 	}
+	return sources
+}
 
-	processingTime := time.Since(startTime)
-	log.Printf("Query answered in %v", processingTime)
-
-	c.JSON(http.StatusOK, models.QueryResponse{
-		Answer:           answer,
-		Sources:          sources,
-		ProcessingTimeMs: processingTime.Milliseconds(),
-	})
+// chunk IDs in the order the passages were numbered in the prompt
+func sourceIDs(sources []models.SourceChunk) []string {
+	ids := make([]string, len(sources))
+	for i, source := range sources {
+		ids[i] = source.ChunkID
+	}
+	return ids
 }
 
 func (rc *RAGController) GetBooks(c *gin.Context) {
@@ -256,3 +663,178 @@ func (rc *RAGController) GetBooks(c *gin.Context) {
 	log.Printf("Successfully retrieved %d books", len(books))
 	c.JSON(http.StatusOK, books)
 }
+
+func (rc *RAGController) GetBook(c *gin.Context) {
+	bookID := c.Param("id")
+	book, err := rc.store.GetBook(context.Background(), bookID)
+	if err != nil {
+		log.Printf("Failed to get book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	if book == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, book)
+}
+
+// UpdateBook edits a book's title, author or tags, the chunks' copies are updated with it
+func (rc *RAGController) UpdateBook(c *gin.Context) {
+	bookID := c.Param("id")
+
+	var req models.UpdateBookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Title == nil && req.Author == nil && req.Tags == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update, set title, author or tags"})
+		return
+	}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title must not be empty"})
+			return
+		}
+		req.Title = &title
+	}
+	if req.Author != nil {
+		author := strings.TrimSpace(*req.Author)
+		if author == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "author must not be empty"})
+			return
+		}
+		req.Author = &author
+	}
+	if req.Tags != nil {
+		tags := services.NormalizeTags(*req.Tags)
+		req.Tags = &tags
+	}
+
+	book, err := rc.store.UpdateBook(context.Background(), bookID, req)
+	if err != nil {
+		log.Printf("Failed to update book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+		return
+	}
+	if book == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+
+	log.Printf("Updated book %s (%s by %s)", bookID, book.Title, book.Author)
+	c.JSON(http.StatusOK, book)
+}
+
+// DeleteBook removes a book along with its chunks and cached summaries
+func (rc *RAGController) DeleteBook(c *gin.Context) {
+	bookID := c.Param("id")
+	found, err := rc.store.DeleteBook(context.Background(), bookID)
+	if err != nil {
+		log.Printf("Failed to delete book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+
+	log.Printf("Deleted book %s", bookID)
+	c.Status(http.StatusNoContent)
+}
+
+// SummarizeBook summarizes a whole book or a range of its chapters
+// the first request for a book can take a while, later ones reuse the cached sections
+func (rc *RAGController) SummarizeBook(c *gin.Context) {
+	startTime := time.Now()
+	bookID := c.Param("id")
+
+	var req models.SummarizeRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	if req.ChapterFrom < 0 || req.ChapterTo < 0 || (req.ChapterTo > 0 && req.ChapterTo < req.ChapterFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter range"})
+		return
+	}
+	if req.TargetWords < 0 || req.TargetWords > maxSummaryWords {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("target_words must be between 0 and %d (0 = default)", maxSummaryWords)})
+		return
+	}
+
+	response, err := rc.summarizer.Summarize(c.Request.Context(), bookID, req)
+	if errors.Is(err, services.ErrNoChunks) {
+		if req.ChapterFrom > 0 || req.ChapterTo > 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No chunks found in the requested chapters"})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to summarize book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize book"})
+		return
+	}
+
+	response.ProcessingTimeMs = time.Since(startTime).Milliseconds()
+	log.Printf("Summarized book %s in %v (%d sections, %d cached)", bookID, time.Since(startTime), response.Sections, response.CachedSections)
+	c.JSON(http.StatusOK, response)
+}
+
+// StartReindex re-embeds one or all books with a new model in the background
+func (rc *RAGController) StartReindex(c *gin.Context) {
+	var req models.ReindexRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	if req.BookID != "" {
+		count, err := rc.store.CountBookChunks(context.Background(), req.BookID)
+		if err != nil {
+			log.Printf("Failed to count chunks for book %s: %v", req.BookID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start reindex"})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+	}
+
+	jobID, err := rc.reindexer.Start(req.BookID, req.Model)
+	if errors.Is(err, services.ErrReindexRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A reindex of this book is already running"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to start reindex: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start reindex: " + err.Error()})
+		return
+	}
+	log.Printf("Started reindex job %s (book_id: %q, model: %q)", jobID, req.BookID, req.Model)
+
+	status, _ := rc.reindexer.Status(jobID)
+	c.JSON(http.StatusAccepted, status)
+}
+
+// GetReindexStatus reports the progress of a reindex job
+func (rc *RAGController) GetReindexStatus(c *gin.Context) {
+	status, ok := rc.reindexer.Status(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reindex job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetrieveChunks runs retrieval only and explains the ranking, no LLM is called
+func (rc *RAGController) RetrieveChunks(c *gin.Context) {
+	var req models.RetrieveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if _, err := storage.ChunkFilterBSON(req.Filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid filter: %v", err)})
+		return
+	}
+
+	topK := req.TopK
+	if topK <= 0 {
+		topK = rc.config.TopK
+	}
+
+	response, err := rc.retriever.Explain(context.Background(), req.Question, topK, req.BookID, req.Filter)
+	if err != nil {
+		log.Printf("Failed to retrieve chunks for '%s': %v", req.Question, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
+		return
+	}
+
+	log.Printf("Retrieve: '%s' (book_id: %s, top-k: %d) scanned %d chunks in %dms", req.Question, req.BookID, topK, response.ChunksScanned, response.Timings.TotalMs)
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/services"
+	"github.com/blavejr/bowattAI/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadBookVersion replaces the text of a book with a corrected one under the same book ID
+// only chunks that changed are embedded, the previous version stays queryable by version
+func (rc *RAGController) UploadBookVersion(c *gin.Context) {
+	startTime := time.Now()
+	bookID := c.Param("id")
+	rc.limitUpload(c)
+
+	ctx := context.Background()
+	book, err := rc.store.GetBook(ctx, bookID)
+	if err != nil {
+		log.Printf("Failed to get book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	if book == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+
+	file, ok := rc.uploadedFile(c)
+	if !ok {
+		return
+	}
+	// read twice like uploads, once to hash it and once to chunk it
+	contentHash, ok := hashUploadedFile(c, file)
+	if !ok {
+		return
+	}
+	src, ok := openUploadedFile(c, file)
+	if !ok {
+		return
+	}
+	defer src.Close()
+
+	version, err := rc.versioner.AddVersion(ctx, bookID, src, contentHash)
+	if errors.Is(err, services.ErrUnchanged) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Text is the same as the current version", "version": book.CurrentVersion()})
+		return
+	}
+	if errors.Is(err, storage.ErrBookBusy) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another version of this book is being uploaded, or it is being reindexed"})
+		return
+	}
+	if errors.Is(err, storage.ErrDuplicateBook) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another book already has this text"})
+		return
+	}
+	if errors.Is(err, services.ErrEmptyText) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to chunk text"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store new version of book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store new version"})
+		return
+	}
+
+	rc.collectVersions(ctx, bookID)
+
+	processingTime := time.Since(startTime)
+	log.Printf("Version %d of book %s processed in %v", version.Version, bookID, processingTime)
+	c.JSON(http.StatusOK, models.UploadBookResponse{
+		BookID:           bookID,
+		Title:            book.Title,
+		Author:           book.Author,
+		TotalChunks:      version.TotalChunks,
+		Version:          version.Version,
+		KeptChunks:       version.KeptChunks,
+		CopiedChunks:     version.CopiedChunks,
+		EmbeddedChunks:   version.EmbeddedChunks,
+		ProcessingTimeMs: processingTime.Milliseconds(),
+		Status:           "success",
+	})
+}
+
+// DeleteBookVersion garbage-collects an old version of a book
+func (rc *RAGController) DeleteBookVersion(c *gin.Context) {
+	bookID := c.Param("id")
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	ctx := context.Background()
+	book, err := rc.store.GetBook(ctx, bookID)
+	if err != nil {
+		log.Printf("Failed to get book %s: %v", bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	if book == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		return
+	}
+	if version == book.CurrentVersion() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The current version can't be deleted, delete the book instead"})
+		return
+	}
+	if !hasVersion(book, version) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+
+	deleted, err := rc.store.DeleteVersion(ctx, bookID, version)
+	if err != nil {
+		log.Printf("Failed to delete version %d of book %s: %v", version, bookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version"})
+		return
+	}
+
+	log.Printf("Deleted version %d of book %s (%d chunks)", version, bookID, deleted)
+	c.JSON(http.StatusOK, gin.H{"book_id": bookID, "version": version, "deleted_chunks": deleted})
+}
+
+// delete the oldest versions of a book beyond KEEP_BOOK_VERSIONS, failures are only logged
+func (rc *RAGController) collectVersions(ctx context.Context, bookID string) {
+	keep := rc.config.KeepBookVersions
+	if keep <= 0 {
+		return
+	}
+
+	book, err := rc.store.GetBook(ctx, bookID)
+	if err != nil || book == nil {
+		log.Printf("Failed to get book %s to collect old versions: %v", bookID, err)
+		return
+	}
+	for _, version := range versionsToCollect(book, keep) {
+		deleted, err := rc.store.DeleteVersion(ctx, bookID, version)
+		if err != nil {
+			log.Printf("Failed to collect version %d of book %s: %v", version, bookID, err)
+			return
+		}
+		log.Printf("Collected version %d of book %s (%d chunks)", version, bookID, deleted)
+	}
+}
+
+// the old versions of a book beyond the newest keep, oldest first
+// the current version is never collected and doesn't count towards keep
+func versionsToCollect(book *models.Book, keep int) []int {
+	var old []int
+	for _, v := range book.Versions {
+		if v.Version != book.CurrentVersion() {
+			old = append(old, v.Version)
+		}
+	}
+	if len(old) <= keep {
+		return nil
+	}
+	return old[:len(old)-keep]
+}
+
+func hasVersion(book *models.Book, version int) bool {
+	// books recorded before versioning only have version 1
+	if len(book.Versions) == 0 {
+		return version == 1
+	}
+	for _, v := range book.Versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
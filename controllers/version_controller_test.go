@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// publish the next version of a book and collect old versions after it, like UploadBookVersion
+func publishAndCollect(book *models.Book, keep int) {
+	book.Version = book.CurrentVersion() + 1
+	book.Versions = append(book.Versions, models.BookVersion{Version: book.Version})
+
+	collected := make(map[int]bool)
+	for _, v := range versionsToCollect(book, keep) {
+		collected[v] = true
+	}
+	var remaining []models.BookVersion
+	for _, v := range book.Versions {
+		if !collected[v.Version] {
+			remaining = append(remaining, v)
+		}
+	}
+	book.Versions = remaining
+}
+
+func TestVersionsToCollect(t *testing.T) {
+	// uploaded as version 1, then two new versions published with one old version kept
+	book := &models.Book{Version: 1, Versions: []models.BookVersion{{Version: 1}}}
+	publishAndCollect(book, 1)
+	publishAndCollect(book, 1)
+
+	var versions []int
+	for _, v := range book.Versions {
+		versions = append(versions, v.Version)
+	}
+	if fmt.Sprint(versions) != "[2 3]" {
+		t.Errorf("versions left = %v, want the current version 3 and one old version 2", versions)
+	}
+}
+
+func TestVersionsToCollectKeepsCurrent(t *testing.T) {
+	book := &models.Book{Version: 3, Versions: []models.BookVersion{{Version: 1}, {Version: 2}, {Version: 3}}}
+	if got := versionsToCollect(book, 1); fmt.Sprint(got) != "[1]" {
+		t.Errorf("keep 1 collects %v, want [1]", got)
+	}
+	if got := versionsToCollect(book, 2); got != nil {
+		t.Errorf("keep 2 collects %v, want nothing", got)
+	}
+}
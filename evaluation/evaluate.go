@@ -59,10 +59,10 @@ type Evaluator struct {
 	generator *services.Generator
 }
 
-func NewEvaluator(cfg *config.Config, store *storage.MongoStore) *Evaluator {
-	embedder := services.NewEmbedder(cfg.OllamaURL, cfg.OllamaEmbedModel)
-	generator := services.NewGenerator(cfg.OllamaURL, cfg.OllamaLLMModel)
-	retriever := services.NewRetriever(store, embedder)
+func NewEvaluator(cfg *config.Config, store *storage.MongoStore, templates *services.PromptTemplates) *Evaluator {
+	embedder := services.NewEmbedder(services.NewEmbeddingProvider(cfg), cfg.EmbeddingModel(), cfg.EmbeddingPrefixes)
+	generator := services.NewGenerator(services.NewChatProvider(cfg), cfg.LLMModel(), cfg.LLMOptions, templates)
+	retriever := services.NewRetriever(store, embedder, generator)
 
 	return &Evaluator{
 		config:    cfg,
@@ -86,7 +86,8 @@ func LoadDataset(filepath string) ([]Question, error) {
 	return questions, nil
 }
 
-func (e *Evaluator) Evaluate(questions []Question, bookID string) (*EvaluationReport, error) {
+// Evaluate answers every question, retrieving with the given query expansion ("none", "hyde", "multi_query")
+func (e *Evaluator) Evaluate(questions []Question, bookID, expansion string) (*EvaluationReport, error) {
 	results := make([]EvaluationResult, 0, len(questions))
 
 	totalResponseTime := int64(0)
@@ -96,8 +97,13 @@ func (e *Evaluator) Evaluate(questions []Question, bookID string) (*EvaluationRe
 
 	ctx := context.Background()
 
+	if expansion == "" {
+		expansion = services.ExpansionNone
+	}
+
 	fmt.Println("Starting evaluation...")
 	fmt.Printf("Total questions: %d\n", len(questions))
+	fmt.Printf("Query expansion: %s\n", expansion)
 	fmt.Println("---")
 
 	for i, q := range questions {
@@ -106,12 +112,15 @@ func (e *Evaluator) Evaluate(questions []Question, bookID string) (*EvaluationRe
 		startTime := time.Now()
 
 		// retrieve chunks
-		searchResults, err := e.retriever.Retrieve(ctx, q.Question, e.config.TopK, bookID)
+		searchResults, _, err := e.retriever.RetrieveExpanded(ctx, q.Question, e.config.TopK, bookID, nil, expansion, e.config.QueryExpansionCount)
 		if err != nil {
 			fmt.Printf("Failed: %v\n", err)
 			continue
 		}
 
+		// keep what the generator would actually see within the context budget
+		searchResults, _ = services.PackContexts(searchResults, e.config.ContextTokenBudget)
+
 		// generate answer
 		contexts := make([]string, len(searchResults))
 		for j, result := range searchResults {
@@ -202,11 +211,16 @@ func (e *Evaluator) Evaluate(questions []Question, bookID string) (*EvaluationRe
 		AvgFScore:          avgFScore,
 		Timestamp:          time.Now().Format(time.RFC3339),
 		Configuration: map[string]interface{}{
-			"chunk_size":    e.config.ChunkSize,
-			"chunk_overlap": e.config.ChunkOverlap,
-			"top_k":         e.config.TopK,
-			"embed_model":   e.config.OllamaEmbedModel,
-			"llm_model":     e.config.OllamaLLMModel,
+			"chunk_size":     e.config.ChunkSize,
+			"chunk_overlap":  e.config.ChunkOverlap,
+			"top_k":          e.config.TopK,
+			"context_budget": e.config.ContextTokenBudget,
+			"embed_model":    e.config.EmbeddingModel(),
+			"llm_model":      e.config.LLMModel(),
+			"embed_backend":  e.config.EmbeddingProvider,
+			"llm_backend":    e.config.LLMProvider,
+			"llm_options":    e.config.LLMOptions,
+			"expansion":      expansion,
 		},
 	}
 
@@ -304,6 +318,19 @@ func SaveReport(report *EvaluationReport, filepath string) error {
 	return nil
 }
 
+// print the headline metrics of several runs side by side, e.g. one per query expansion
+func PrintComparison(names []string, reports []*EvaluationReport) {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	fmt.Println("COMPARISON")
+	fmt.Println(strings.Repeat("=", 60))
+	fmt.Printf("%-14s %10s %10s %10s %10s\n", "Run", "Accuracy", "F-Score", "Relevant", "Time (ms)")
+	for i, report := range reports {
+		m := report.Metrics
+		fmt.Printf("%-14s %9.2f%% %10.3f %10.1f %10.0f\n", names[i], m.RetrievalAccuracy*100, m.AvgFScore, m.AvgRelevantChunks, m.AvgResponseTime)
+	}
+	fmt.Println(strings.Repeat("=", 60) + "\n")
+}
+
 // print a summary of the evaluation results
 func PrintSummary(report *EvaluationReport) {
 	fmt.Println("\n" + strings.Repeat("=", 60))
@@ -320,7 +347,14 @@ func PrintSummary(report *EvaluationReport) {
 
 	fmt.Println("\nConfiguration:")
 	for key, value := range report.Metrics.Configuration {
-		fmt.Printf("  %s: %v\n", key, value)
+		switch value.(type) {
+		case string, int, bool, float64:
+			fmt.Printf("  %s: %v\n", key, value)
+		default:
+			// structs like the LLM options hold pointers, print them as JSON
+			data, _ := json.Marshal(value)
+			fmt.Printf("  %s: %s\n", key, data)
+		}
 	}
 	fmt.Println(strings.Repeat("=", 60) + "\n")
 }
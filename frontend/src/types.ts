@@ -2,24 +2,90 @@ export interface Book {
   id: string;
   title: string;
   author: string;
+  tags?: string[];
+  total_chunks: number;
+  total_chars: number;
+  chunk_size: number;
+  chunk_overlap: number;
+  embedding_model?: string;
+  embedding_dim?: number;
+  chapters?: number;
+  prompt_template?: string;
+  content_hash?: string;
+  original_book_id?: string;
+  version?: number;
+  versions?: BookVersion[];
+  status?: 'pending' | 'ready';
+  uploaded_at: string;
+  updated_at?: string;
+}
+
+export interface BookVersion {
+  version: number;
+  content_hash?: string;
+  total_chunks: number;
+  total_chars: number;
+  chapters?: number;
+  kept_chunks: number;
+  copied_chunks: number;
+  embedded_chunks: number;
   uploaded_at: string;
 }
 
 export interface SourceChunk {
   chunk_id: string;
+  book_id?: string;
   text: string;
   score: number;
+  normalized_score?: number;
   metadata: {
     book_title: string;
     book_author: string;
     character_start: number;
     character_end: number;
+    has_offsets?: boolean;
     chunk_size: number;
   };
 }
 
+export interface AnswerSegment {
+  text: string;
+  citations: number[];
+  chunk_ids: string[];
+  invalid_citations?: number[];
+}
+
+export interface Citation {
+  marker: number;
+  chunk_id?: string;
+  valid: boolean;
+}
+
 export interface QueryResponse {
   answer: string;
+  segments: AnswerSegment[];
+  citations: Citation[];
   sources: SourceChunk[];
   processing_time_ms: number;
+  route: 'metadata' | 'retrieval' | 'summary' | 'multi_hop';
+  route_reason?: string;
+  summary?: string;
+  steps?: DecompositionStep[];
+  expansion?: 'none' | 'hyde' | 'multi_query';
+  expanded_queries?: string[];
+  source_groups?: BookSources[];
+}
+
+export interface BookSources {
+  book_id: string;
+  title: string;
+  author: string;
+  sources: SourceChunk[];
+}
+
+export interface DecompositionStep {
+  sub_question: string;
+  chunk_ids: string[];
+  scores: number[];
+  new_chunks: number;
 }
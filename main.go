@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/blavejr/bowattAI/config"
 	"github.com/blavejr/bowattAI/controllers"
 	"github.com/blavejr/bowattAI/evaluation"
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/services"
 	"github.com/blavejr/bowattAI/storage"
 
 	"github.com/gin-gonic/gin"
@@ -16,16 +22,31 @@ import (
 
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "evaluate" {
-		// usage: go run main.go evaluate [book_id]
+		// usage: go run main.go evaluate [--expansion none,hyde,multi_query] [book_id]
 		runEvaluation()
 		return
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		// usage: go run main.go reindex [--book id] [--model m]
+		runReindex()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "ingest" {
+		// usage: go run main.go ingest [--workers n] [--force] <path>
+		runIngest()
+		return
+	}
+
 	runServer()
 }
 
 func runServer() {
 	cfg := config.Load()
+	if err := services.ValidateOptions(cfg.LLMOptions); err != nil {
+		log.Fatalf("Invalid LLM_* generation options: %v", err)
+	}
 
 	mongoStore, err := storage.NewMongoStore(cfg)
 	if err != nil {
@@ -35,6 +56,22 @@ func runServer() {
 	if err := mongoStore.EnsureVectorIndex(); err != nil {
 		log.Printf("Note: Vector index creation skipped (using simple cosine similarity)")
 	}
+	if err := mongoStore.EnsureBookIndexes(context.Background()); err != nil {
+		log.Printf("Warning: could not index books by content, concurrent duplicate uploads won't be caught: %v", err)
+	}
+	checkEmbeddingModels(cfg, mongoStore)
+	cleanupPending(mongoStore, cfg)
+	// uploads whose rollback failed would otherwise stay pending until the next restart
+	go func() {
+		for range time.Tick(pendingSweepInterval) {
+			cleanupPending(mongoStore, cfg)
+		}
+	}()
+	if created, err := mongoStore.BackfillBooks(context.Background()); err != nil {
+		log.Printf("Warning: could not create records for existing books: %v", err)
+	} else if created > 0 {
+		log.Printf("Created records for %d existing books", created)
+	}
 
 	if cfg.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
@@ -46,7 +83,7 @@ func runServer() {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -56,7 +93,12 @@ func runServer() {
 		c.Next()
 	})
 
-	ragController := controllers.NewRAGController(cfg, mongoStore)
+	templates, err := services.LoadPromptTemplates(cfg.PromptTemplatesDir, cfg.DefaultPromptTemplate)
+	if err != nil {
+		log.Fatalf("Failed to load prompt templates: %v", err)
+	}
+
+	ragController := controllers.NewRAGController(cfg, mongoStore, templates)
 
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -69,13 +111,35 @@ func runServer() {
 	{
 		api.GET("/books", ragController.GetBooks)
 		api.POST("/books", ragController.UploadBook)
+		api.GET("/books/:id", ragController.GetBook)
+		api.PATCH("/books/:id", ragController.UpdateBook)
+		api.DELETE("/books/:id", ragController.DeleteBook)
+		api.GET("/books/:id/chunks", ragController.ListChunks)
+		api.POST("/books/:id/versions", ragController.UploadBookVersion)
+		api.DELETE("/books/:id/versions/:version", ragController.DeleteBookVersion)
+		api.POST("/books/:id/summarize", ragController.SummarizeBook)
+		api.GET("/chunks/:id", ragController.GetChunk)
+		api.POST("/retrieve", ragController.RetrieveChunks)
 		api.POST("/query", ragController.QueryBook)
+		api.POST("/query/stream", ragController.QueryBookStream)
+
+		api.GET("/conversations", ragController.ListConversations)
+		api.POST("/conversations", ragController.CreateConversation)
+		api.GET("/conversations/:id", ragController.GetConversation)
+		api.PATCH("/conversations/:id", ragController.RenameConversation)
+		api.DELETE("/conversations/:id", ragController.DeleteConversation)
+		api.POST("/conversations/:id/messages", ragController.SendMessage)
+
+		admin := api.Group("/admin")
+		admin.POST("/reindex", ragController.StartReindex)
+		admin.GET("/reindex/:id", ragController.GetReindexStatus)
 	}
 
 	addr := fmt.Sprintf(":%s", cfg.Port)
 	log.Printf("RAG Pipeline server starting on %s", addr)
 	log.Printf("MongoDB: %s", cfg.MongoDatabase)
-	log.Printf("Ollama: %s", cfg.OllamaURL)
+	log.Printf("Embeddings: %s (%s)", cfg.EmbeddingModel(), cfg.EmbeddingProvider)
+	log.Printf("LLM: %s (%s)", cfg.LLMModel(), cfg.LLMProvider)
 	log.Printf("Environment: %s", cfg.Environment)
 
 	if err := router.Run(addr); err != nil {
@@ -83,10 +147,87 @@ func runServer() {
 	}
 }
 
+// how often unfinished uploads older than PENDING_UPLOAD_TIMEOUT are looked for while serving
+const pendingSweepInterval = 5 * time.Minute
+
+// abort uploads, versions and reindexes left unfinished for longer than PENDING_UPLOAD_TIMEOUT
+func cleanupPending(store *storage.MongoStore, cfg *config.Config) {
+	cutoff := time.Now().Add(-time.Duration(cfg.PendingUploadTimeout) * time.Minute)
+	if books, versions, err := store.CleanupPending(context.Background(), cutoff); err != nil {
+		log.Printf("Warning: could not clean up unfinished uploads: %v", err)
+	} else if books > 0 || versions > 0 {
+		log.Printf("Cleaned up %d unfinished uploads and %d unfinished versions", books, versions)
+	}
+}
+
+// compare the configured embedding model with what the stored chunks were embedded with
+// books keep being queried with their own model, but legacy chunks (no recorded model) and
+// chunks whose dimension no longer matches their model would silently stop matching
+func checkEmbeddingModels(cfg *config.Config, store *storage.MongoStore) {
+	infos, err := store.GetEmbeddingModels(context.Background())
+	if err != nil {
+		log.Printf("Warning: could not check stored embedding models: %v", err)
+		return
+	}
+
+	embedder := services.NewEmbedder(services.NewEmbeddingProvider(cfg), cfg.EmbeddingModel(), cfg.EmbeddingPrefixes)
+	dims := map[string]int{}
+	dimFor := func(model string) int {
+		if dim, ok := dims[model]; ok {
+			return dim
+		}
+		dim := 0
+		if embedding, err := embedder.GenerateEmbeddingWithModel("test", model); err != nil {
+			log.Printf("Warning: could not determine dimension of embedding model %s: %v", model, err)
+		} else {
+			dim = len(embedding)
+		}
+		dims[model] = dim
+		return dim
+	}
+
+	mismatches := 0
+	for _, info := range infos {
+		model := info.Model
+		if model == "" {
+			// chunks from before the model was recorded are queried with the configured model
+			model = cfg.EmbeddingModel()
+		}
+
+		if info.Model != "" && info.Model != cfg.EmbeddingModel() {
+			log.Printf("Warning: %d chunks were embedded with %s (dim %d) but the configured embedding model is %s; those books will be queried with %s", info.Chunks, info.Model, info.Dim, cfg.EmbeddingModel(), info.Model)
+		}
+
+		if dim := dimFor(model); dim > 0 && dim != info.Dim {
+			log.Printf("Warning: %d chunks have %d-dim embeddings but %s produces %d-dim embeddings; re-index the affected books", info.Chunks, info.Dim, model, dim)
+			mismatches++
+		}
+	}
+
+	if mismatches > 0 && cfg.EmbeddingStrict {
+		log.Fatalf("Embedding dimension mismatch for %d model(s) and EMBEDDING_STRICT is set, refusing to start", mismatches)
+	}
+}
+
 func runEvaluation() {
+	flags := flag.NewFlagSet("evaluate", flag.ExitOnError)
+	expansions := flags.String("expansion", services.ExpansionNone, "comma-separated query expansions to benchmark: none, hyde, multi_query")
+	flags.Parse(os.Args[2:])
+
 	log.Println("Starting evaluation mode...")
 
 	cfg := config.Load()
+	if err := services.ValidateOptions(cfg.LLMOptions); err != nil {
+		log.Fatalf("Invalid LLM_* generation options: %v", err)
+	}
+
+	runs := strings.Split(*expansions, ",")
+	for i, name := range runs {
+		runs[i] = strings.TrimSpace(name)
+		if runs[i] == "" || !services.IsExpansion(runs[i]) {
+			log.Fatalf("Unknown query expansion %q (expected none, hyde or multi_query)", name)
+		}
+	}
 
 	store, err := storage.NewMongoStore(cfg)
 	if err != nil {
@@ -95,8 +236,8 @@ func runEvaluation() {
 	defer store.Close()
 
 	bookID := ""
-	if len(os.Args) > 2 {
-		bookID = os.Args[2]
+	if flags.NArg() > 0 {
+		bookID = flags.Arg(0)
 		log.Printf("Using provided book ID: %s", bookID)
 	} else {
 		bookIDs, err := store.GetUniqueBookIDs(context.TODO())
@@ -114,19 +255,158 @@ func runEvaluation() {
 	}
 	log.Printf("Loaded %d questions from %s", len(questions), datasetPath)
 
-	evaluator := evaluation.NewEvaluator(cfg, store)
+	templates, err := services.LoadPromptTemplates(cfg.PromptTemplatesDir, cfg.DefaultPromptTemplate)
+	if err != nil {
+		log.Fatalf("Failed to load prompt templates: %v", err)
+	}
+
+	evaluator := evaluation.NewEvaluator(cfg, store, templates)
+
+	reports := make([]*evaluation.EvaluationReport, 0, len(runs))
+	for _, expansion := range runs {
+		report, err := evaluator.Evaluate(questions, bookID, expansion)
+		if err != nil {
+			log.Fatalf("Evaluation failed: %v", err)
+		}
+
+		evaluation.PrintSummary(report)
+
+		// runs without expansion keep the original baseline file name
+		outputFile := "evaluation/results/baseline.json"
+		if expansion != services.ExpansionNone {
+			outputFile = fmt.Sprintf("evaluation/results/expansion_%s.json", expansion)
+		}
+		if err := evaluation.SaveReport(report, outputFile); err != nil {
+			log.Fatalf("Failed to save report: %v", err)
+		}
+		log.Printf("Results saved to %s", outputFile)
 
-	report, err := evaluator.Evaluate(questions, bookID)
+		reports = append(reports, report)
+	}
+
+	if len(reports) > 1 {
+		evaluation.PrintComparison(runs, reports)
+	}
+
+	log.Printf("Evaluation complete!")
+}
+
+func runReindex() {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	bookID := flags.String("book", "", "book ID to reindex (default: all books)")
+	model := flags.String("model", "", "embedding model to use (default: the configured embedding model)")
+	flags.Parse(os.Args[2:])
+
+	cfg := config.Load()
+	if *model == "" {
+		*model = cfg.EmbeddingModel()
+	}
+
+	store, err := storage.NewMongoStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer store.Close()
+
+	embedder := services.NewEmbedder(services.NewEmbeddingProvider(cfg), cfg.EmbeddingModel(), cfg.EmbeddingPrefixes)
+	reindexer := services.NewReindexer(store, embedder)
+
+	log.Printf("Reindexing %s with embedding model %s...", describeBook(*bookID), *model)
+	startTime := time.Now()
+	lastLogged := time.Time{}
+	var skipped []string
+	err = reindexer.Reindex(context.Background(), *bookID, *model, func(s models.ReindexStatus) {
+		skipped = s.SkippedBooks
+		if time.Since(lastLogged) < time.Second && s.ProcessedChunks < s.TotalChunks {
+			return
+		}
+		lastLogged = time.Now()
+		log.Printf("Progress: %d/%d chunks, %d books done", s.ProcessedChunks, s.TotalChunks, s.BooksDone)
+	})
+	if err != nil {
+		log.Fatalf("Reindex failed: %v", err)
+	}
+
+	log.Printf("Reindex complete in %v", time.Since(startTime))
+	if len(skipped) > 0 {
+		log.Printf("Skipped %d busy books, reindex them with --book once their uploads finish: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+}
+
+func runIngest() {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	workers := flags.Int("workers", 4, "number of books ingested at the same time")
+	force := flags.Bool("force", false, "ingest books whose text was already ingested as new books")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		log.Fatalf("Usage: go run main.go ingest [--workers n] [--force] <path>")
+	}
+	root := flags.Arg(0)
+
+	cfg := config.Load()
+
+	files, err := services.ScanBooks(root)
 	if err != nil {
-		log.Fatalf("Evaluation failed: %v", err)
+		log.Fatalf("Failed to find books: %v", err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("No books found in %s", root)
 	}
+	log.Printf("Found %d files in %s", len(files), root)
 
-	evaluation.PrintSummary(report)
+	templates, err := services.LoadPromptTemplates(cfg.PromptTemplatesDir, cfg.DefaultPromptTemplate)
+	if err != nil {
+		log.Fatalf("Failed to load prompt templates: %v", err)
+	}
+	for i, file := range files {
+		if file.Err == nil && file.PromptTemplate != "" && !templates.Has(file.PromptTemplate) {
+			files[i].Err = fmt.Errorf("unknown prompt template %q", file.PromptTemplate)
+		}
+	}
 
-	outputFile := "evaluation/results/baseline.json"
-	if err := evaluation.SaveReport(report, outputFile); err != nil {
-		log.Fatalf("Failed to save report: %v", err)
+	store, err := storage.NewMongoStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
+	defer store.Close()
+	if err := store.EnsureBookIndexes(context.Background()); err != nil {
+		log.Printf("Warning: could not index books by content, concurrent duplicate uploads won't be caught: %v", err)
+	}
+
+	chunker := services.NewChunker(cfg.ChunkSize, cfg.ChunkOverlap)
+	embedder := services.NewEmbedder(services.NewEmbeddingProvider(cfg), cfg.EmbeddingModel(), cfg.EmbeddingPrefixes)
+	ingester := services.NewIngester(store, chunker, embedder, cfg.IngestBatchSize)
+
+	startTime := time.Now()
+	results := ingester.IngestFiles(context.Background(), files, *workers, *force)
+	failed := printIngestSummary(results)
+
+	if failed > 0 {
+		log.Fatalf("%d file(s) failed to ingest", failed)
+	}
+	log.Printf("Ingest complete in %v", time.Since(startTime))
+}
+
+// print a row per file, returns the number that failed
+func printIngestSummary(results []services.IngestResult) int {
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tFORMAT\tTITLE\tAUTHOR\tFROM\tSTATUS\tCHUNKS\tBOOK ID\tTIME\tREASON")
+	for _, r := range results {
+		counts[r.Status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%v\t%s\n",
+			r.File.Path, r.File.Format, r.File.Title, r.File.Author, r.File.Source,
+			r.Status, r.Chunks, r.BookID, r.Duration.Round(time.Millisecond), r.Reason)
+	}
+	w.Flush()
 
-	log.Printf("Evaluation complete! Results saved to %s", outputFile)
+	fmt.Printf("\n%d ingested, %d skipped, %d failed\n", counts[services.IngestIngested], counts[services.IngestSkipped], counts[services.IngestFailed])
+	return counts[services.IngestFailed]
+}
+
+func describeBook(bookID string) string {
+	if bookID == "" {
+		return "all books"
+	}
+	return fmt.Sprintf("book %s", bookID)
 }
@@ -0,0 +1,40 @@
+package models
+
+// query parameters for listing a book's chunks
+type ListChunksRequest struct {
+	After      *int   `form:"after"`      // only chunks with a higher chunk_index
+	Limit      int    `form:"limit"`      // page size
+	Text       string `form:"q"`          // case-insensitive substring of the chunk text
+	Embeddings bool   `form:"embeddings"` // include the stored vectors
+	Version    int    `form:"version"`    // the current version when 0
+}
+
+type GetChunkRequest struct {
+	Neighbours *int `form:"neighbours"` // chunks on each side, default 1
+	Embeddings bool `form:"embeddings"`
+}
+
+// ChunkView is a stored chunk as the API shows it, with its embedding when asked for
+type ChunkView struct {
+	Chunk
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+type ChunkPage struct {
+	BookID string      `json:"book_id"`
+	Chunks []ChunkView `json:"chunks"`
+	Total  int64       `json:"total"` // chunks matching the text filter
+	Limit  int         `json:"limit"`
+	// pass as after to get the next page, absent on the last page
+	NextAfter *int `json:"next_after,omitempty"`
+}
+
+type ChunkDetail struct {
+	Chunk    ChunkView   `json:"chunk"`
+	Previous []ChunkView `json:"previous"` // in chunk order
+	Next     []ChunkView `json:"next"`
+}
+
+func NewChunkView(chunk Chunk) ChunkView {
+	return ChunkView{Chunk: chunk, Embedding: chunk.Embedding}
+}
@@ -12,63 +12,344 @@ type Chunk struct {
 	ChunkIndex int                `bson:"chunk_index" json:"chunk_index"`
 	Text       string             `bson:"text" json:"text"`
 	Embedding  []float32          `bson:"embedding" json:"-"`
-	Metadata   ChunkMetadata      `bson:"metadata" json:"metadata"`
-	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	// written by a reindex, read instead of Embedding while the book's ShadowActive is set
+	EmbeddingNext  []float32     `bson:"embedding_next,omitempty" json:"-"`
+	EmbeddingModel string        `bson:"embedding_model,omitempty" json:"embedding_model,omitempty"`
+	EmbeddingDim   int           `bson:"embedding_dim,omitempty" json:"embedding_dim,omitempty"`
+	Metadata       ChunkMetadata `bson:"metadata" json:"metadata"`
+	// hash of the chunk text, unchanged chunks are kept when a new version is uploaded
+	ContentHash string `bson:"content_hash,omitempty" json:"content_hash,omitempty"`
+	// versions of the book the chunk belongs to, missing on chunks uploaded before versioning (version 1)
+	Versions  []int     `bson:"versions,omitempty" json:"versions,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
 }
 
 type ChunkMetadata struct {
 	BookTitle      string `bson:"book_title" json:"book_title"`
 	BookAuthor     string `bson:"book_author" json:"book_author"`
-	CharacterStart int    `bson:"character_start" json:"character_start"`
+	Chapter        int    `bson:"chapter,omitempty" json:"chapter,omitempty"`
+	CharacterStart int    `bson:"character_start" json:"character_start"` // byte offsets into the text after whitespace normalisation
 	CharacterEnd   int    `bson:"character_end" json:"character_end"`
 	ChunkSize      int    `bson:"chunk_size" json:"chunk_size"`
+	// false for chunks stored before offsets were recorded, whose start is 0 and end their length
+	HasOffsets bool `bson:"has_offsets,omitempty" json:"has_offsets,omitempty"`
+	// prompt template used for this book unless the query picks one
+	PromptTemplate string `bson:"prompt_template,omitempty" json:"prompt_template,omitempty"`
+	// labels for filtering library-wide searches, e.g. "fiction", "19th-century"
+	Tags []string `bson:"tags,omitempty" json:"tags,omitempty"`
 }
 
 type Book struct {
-	ID           string    `bson:"_id,omitempty" json:"id"`
-	Title        string    `bson:"title" json:"title"`
-	Author       string    `bson:"author" json:"author"`
-	TotalChunks  int       `bson:"total_chunks" json:"total_chunks"`
-	TotalChars   int       `bson:"total_chars" json:"total_chars"`
-	ChunkSize    int       `bson:"chunk_size" json:"chunk_size"`
-	ChunkOverlap int       `bson:"chunk_overlap" json:"chunk_overlap"`
+	ID             string   `bson:"_id,omitempty" json:"id"`
+	Title          string   `bson:"title" json:"title"`
+	Author         string   `bson:"author" json:"author"`
+	TotalChunks    int      `bson:"total_chunks" json:"total_chunks"`
+	TotalChars     int      `bson:"total_chars" json:"total_chars"`
+	ChunkSize      int      `bson:"chunk_size" json:"chunk_size"`
+	ChunkOverlap   int      `bson:"chunk_overlap" json:"chunk_overlap"`
+	EmbeddingModel string   `bson:"embedding_model,omitempty" json:"embedding_model,omitempty"`
+	EmbeddingDim   int      `bson:"embedding_dim,omitempty" json:"embedding_dim,omitempty"`
+	Chapters       int      `bson:"chapters,omitempty" json:"chapters,omitempty"` // chapters detected at upload, 0 if none
+	Tags           []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	PromptTemplate string   `bson:"prompt_template,omitempty" json:"prompt_template,omitempty"`
+	// hash of the normalised text, to spot the same file being uploaded again
+	ContentHash string `bson:"content_hash,omitempty" json:"content_hash,omitempty"`
+	// the first book uploaded with the same content, set when it was uploaded again with force
+	OriginalBookID string `bson:"original_book_id,omitempty" json:"original_book_id,omitempty"`
+	// ContentHash of books without an OriginalBookID, unique so two uploads of the same text can't both succeed
+	// a partial index can't select documents missing original_book_id, so the hash is copied to its own field
+	CanonicalHash string `bson:"canonical_hash,omitempty" json:"-"`
+	// current version, 0 on books recorded before versioning which are at version 1
+	Version int `bson:"version,omitempty" json:"version,omitempty"`
+	// versions whose chunks are still stored, oldest first
+	Versions []BookVersion `bson:"versions,omitempty" json:"versions,omitempty"`
+	// BookPending until every chunk of the upload is stored, missing on books from before uploads were staged
+	Status string `bson:"status,omitempty" json:"status,omitempty"`
+	// version being uploaded, rolled back if the upload doesn't finish
+	PendingVersion int `bson:"pending_version,omitempty" json:"pending_version,omitempty"`
+	// reindex holding the book, new versions aren't stored until it finishes
+	ReindexClaim string `bson:"reindex_claim,omitempty" json:"-"`
+	// set while a reindex swaps in new embeddings, queries read the chunks' embedding_next instead of embedding
+	ShadowActive bool      `bson:"shadow_active,omitempty" json:"-"`
 	UploadedAt   time.Time `bson:"uploaded_at" json:"uploaded_at"`
+	UpdatedAt    time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+// book upload states
+const (
+	BookPending = "pending"
+	BookReady   = "ready"
+)
+
+// CurrentVersion is the book's version, counting books from before versioning as version 1
+func (b *Book) CurrentVersion() int {
+	if b.Version == 0 {
+		return 1
+	}
+	return b.Version
+}
+
+type BookVersion struct {
+	Version     int    `bson:"version" json:"version"`
+	ContentHash string `bson:"content_hash,omitempty" json:"content_hash,omitempty"`
+	TotalChunks int    `bson:"total_chunks" json:"total_chunks"`
+	TotalChars  int    `bson:"total_chars" json:"total_chars"`
+	Chapters    int    `bson:"chapters,omitempty" json:"chapters,omitempty"`
+	// chunks carried over from the previous version unchanged, chunks whose embedding was copied
+	// from an identical chunk that moved, and chunks that had to be embedded
+	KeptChunks     int       `bson:"kept_chunks" json:"kept_chunks"`
+	CopiedChunks   int       `bson:"copied_chunks" json:"copied_chunks"`
+	EmbeddedChunks int       `bson:"embedded_chunks" json:"embedded_chunks"`
+	UploadedAt     time.Time `bson:"uploaded_at" json:"uploaded_at"`
+}
+
+// ChapterCount counts the chapters of a book from the chapter of each of its chunks, in order
+// numbering may restart in books split into volumes or parts, so chapter changes are counted rather than the highest number taken
+type ChapterCount struct {
+	Chapters int
+	current  int
+}
+
+// Add records the chapter of the next chunk, 0 before the first heading
+func (c *ChapterCount) Add(chapter int) {
+	if chapter != 0 && chapter != c.current {
+		c.Chapters++
+	}
+	c.current = chapter
+}
+
+// fields left out are not changed
+type UpdateBookRequest struct {
+	Title  *string   `json:"title,omitempty"`
+	Author *string   `json:"author,omitempty"`
+	Tags   *[]string `json:"tags,omitempty"`
+}
+
+// EmbeddingInfo describes which embedding model produced a set of chunks
+type EmbeddingInfo struct {
+	Model  string `bson:"model" json:"model"`
+	Dim    int    `bson:"dim" json:"dim"`
+	Chunks int    `bson:"chunks" json:"chunks"`
 }
 
 type SearchResult struct {
 	Chunk Chunk   `json:"chunk"`
 	Score float64 `json:"score"`
+	// how far the score stands out among the chunks of its book, set by searches across books
+	NormalizedScore float64 `json:"normalized_score,omitempty"`
+	// the chunk text was cut to fit the context budget
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 type UploadBookRequest struct {
-	Title  string `form:"title" binding:"required"`
-	Author string `form:"author" binding:"required"`
+	Title          string `form:"title" binding:"required"`
+	Author         string `form:"author" binding:"required"`
+	PromptTemplate string `form:"prompt_template"`
+	Tags           string `form:"tags"` // comma-separated
 }
 
 type UploadBookResponse struct {
-	BookID           string `json:"book_id"`
-	Title            string `json:"title"`
-	Author           string `json:"author"`
-	TotalChunks      int    `json:"total_chunks"`
+	BookID         string `json:"book_id"`
+	Title          string `json:"title"`
+	Author         string `json:"author"`
+	TotalChunks    int    `json:"total_chunks"`
+	OriginalBookID string `json:"original_book_id,omitempty"`
+	// set when uploading a new version of a book
+	Version          int    `json:"version,omitempty"`
+	KeptChunks       int    `json:"kept_chunks,omitempty"`
+	CopiedChunks     int    `json:"copied_chunks,omitempty"`
+	EmbeddedChunks   int    `json:"embedded_chunks,omitempty"`
 	ProcessingTimeMs int64  `json:"processing_time_ms"`
 	Status           string `json:"status"`
 }
 
 type QueryRequest struct {
 	Question string `json:"question" binding:"required"`
-	BookID   string `json:"book_id,omitempty"`
-	TopK     int    `json:"top_k,omitempty"`
+	// a single book, or search several: book_ids, books with any of tags, books by author
+	// with none of these the whole library is searched
+	BookID         string   `json:"book_id,omitempty"`
+	BookIDs        []string `json:"book_ids,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	Author         string   `json:"author,omitempty"`
+	TopK           int      `json:"top_k,omitempty"`
+	PromptTemplate string   `json:"prompt_template,omitempty"`
+	// LLM to use instead of the configured one, must be in LLM_MODEL_ALLOWLIST
+	Model   string            `json:"model,omitempty"`
+	Options GenerationOptions `json:"options,omitempty"`
+	// refuse the answer if it isn't supported by the passages, and check claims with the LLM
+	Strict        bool `json:"strict,omitempty"`
+	VerifyWithLLM bool `json:"verify_with_llm,omitempty"`
+	// skip the router: "metadata", "retrieval", "summary" or "multi_hop"
+	Route string `json:"route,omitempty"`
+	// let the LLM classify questions the routing rules don't recognise
+	RouteWithLLM bool `json:"route_with_llm,omitempty"`
+	// rewrite the query before retrieval: "none", "hyde" or "multi_query"
+	Expansion string `json:"expansion,omitempty"`
+	// only retrieve chunks whose metadata matches
+	Filter *ChunkFilter `json:"filter,omitempty"`
 }
 
 type QueryResponse struct {
-	Answer           string        `json:"answer"`
+	Answer    string          `json:"answer"`
+	Segments  []AnswerSegment `json:"segments"`
+	Citations []Citation      `json:"citations"`
+	// passages given to the LLM, and retrieved ones left out to stay within the context budget
 	Sources          []SourceChunk `json:"sources"`
+	DroppedSources   []SourceChunk `json:"dropped_sources"`
 	ProcessingTimeMs int64         `json:"processing_time_ms"`
+	// model and options the answer was generated with, for reproducing it
+	Model   string            `json:"model"`
+	Options GenerationOptions `json:"options"`
+	// share of answer sentences supported by the sources, absent when verification is off
+	GroundedScore        *float64 `json:"grounded_score,omitempty"`
+	UnsupportedSentences []string `json:"unsupported_sentences,omitempty"`
+	// the generated answer failed verification in strict mode and was replaced
+	Refused bool `json:"refused,omitempty"`
+	// how the question was answered and why that route was chosen
+	Route       string `json:"route"`
+	RouteReason string `json:"route_reason,omitempty"`
+	// the book or chapter summary the answer was generated from, on the summary route
+	Summary string `json:"summary,omitempty"`
+	// the sub-questions evidence was retrieved for, on the multi-hop route
+	Steps []DecompositionStep `json:"steps,omitempty"`
+	// query expansion used and the hypothetical answer or paraphrases it searched with
+	Expansion       string   `json:"expansion,omitempty"`
+	ExpandedQueries []string `json:"expanded_queries,omitempty"`
+	// sources grouped by book, for queries across several books
+	SourceGroups []BookSources `json:"source_groups,omitempty"`
+}
+
+// the sources of a cross-book answer that came from one book
+type BookSources struct {
+	BookID  string        `json:"book_id"`
+	Title   string        `json:"title"`
+	Author  string        `json:"author"`
+	Sources []SourceChunk `json:"sources"`
+}
+
+// a sub-question of a multi-hop question and the chunks retrieved for it
+type DecompositionStep struct {
+	SubQuestion string    `json:"sub_question"`
+	ChunkIDs    []string  `json:"chunk_ids"`
+	Scores      []float64 `json:"scores"`
+	NewChunks   int       `json:"new_chunks"` // chunks no earlier sub-question retrieved
+}
+
+// a sentence of the answer and the sources it cites
+type AnswerSegment struct {
+	Text      string   `json:"text"`
+	Citations []int    `json:"citations"` // passage numbers, sources[n-1]
+	ChunkIDs  []string `json:"chunk_ids"`
+	// markers pointing to passages that were not in the context
+	InvalidCitations []int `json:"invalid_citations,omitempty"`
+}
+
+// a [n] marker used in the answer
+type Citation struct {
+	Marker  int    `json:"marker"`
+	ChunkID string `json:"chunk_id,omitempty"`
+	Valid   bool   `json:"valid"`
+}
+
+// final event of a streamed query
+type QueryStreamDone struct {
+	Answer           string            `json:"answer"`
+	Segments         []AnswerSegment   `json:"segments"`
+	Citations        []Citation        `json:"citations"`
+	DroppedSources   []SourceChunk     `json:"dropped_sources"`
+	RetrievalTimeMs  int64             `json:"retrieval_time_ms"`
+	GenerationTimeMs int64             `json:"generation_time_ms"`
+	ProcessingTimeMs int64             `json:"processing_time_ms"`
+	Model            string            `json:"model"`
+	Options          GenerationOptions `json:"options"`
+	Expansion        string            `json:"expansion,omitempty"`
+	ExpandedQueries  []string          `json:"expanded_queries,omitempty"`
+	// streamed tokens can't be taken back, so strict mode is rejected and only the score is reported
+	GroundedScore        *float64 `json:"grounded_score,omitempty"`
+	UnsupportedSentences []string `json:"unsupported_sentences,omitempty"`
 }
 
 type SourceChunk struct {
-	ChunkID  string        `json:"chunk_id"`
-	Text     string        `json:"text"`
-	Score    float64       `json:"score"`
-	Metadata ChunkMetadata `json:"metadata"`
+	ChunkID         string        `bson:"chunk_id" json:"chunk_id"`
+	BookID          string        `bson:"book_id,omitempty" json:"book_id,omitempty"`
+	Text            string        `bson:"text" json:"text"`
+	Score           float64       `bson:"score" json:"score"`
+	NormalizedScore float64       `bson:"normalized_score,omitempty" json:"normalized_score,omitempty"`
+	Truncated       bool          `bson:"truncated,omitempty" json:"truncated,omitempty"`
+	Metadata        ChunkMetadata `bson:"metadata" json:"metadata"`
+}
+
+type ReindexRequest struct {
+	BookID string `json:"book_id,omitempty"`
+	Model  string `json:"model,omitempty"`
+}
+
+type ReindexStatus struct {
+	JobID           string     `json:"job_id,omitempty"`
+	BookID          string     `json:"book_id,omitempty"`
+	Model           string     `json:"model"`
+	Status          string     `json:"status"`
+	BooksDone       int        `json:"books_done"`
+	ProcessedChunks int        `json:"processed_chunks"`
+	TotalChunks     int        `json:"total_chunks"`
+	SkippedBooks    []string   `json:"skipped_books,omitempty"` // books a version upload was holding, left on their old model
+	Error           string     `json:"error,omitempty"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+}
+
+// GenerationOptions are sampling settings passed to the LLM, unset fields use the model's defaults
+// field names match Ollama's "options" object
+type GenerationOptions struct {
+	Temperature *float64 `bson:"temperature,omitempty" json:"temperature,omitempty"`
+	TopP        *float64 `bson:"top_p,omitempty" json:"top_p,omitempty"`
+	NumCtx      *int     `bson:"num_ctx,omitempty" json:"num_ctx,omitempty"`
+	NumPredict  *int     `bson:"num_predict,omitempty" json:"num_predict,omitempty"`
+	Seed        *int     `bson:"seed,omitempty" json:"seed,omitempty"`
+	Stop        []string `bson:"stop,omitempty" json:"stop,omitempty"`
+}
+
+// Summary is a cached summary of a run of chunks at one level of the map-reduce tree
+// level 0 summarizes chunk text, higher levels summarize the summaries below them
+type Summary struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	BookID      string             `bson:"book_id" json:"book_id"`
+	Level       int                `bson:"level" json:"level"`
+	FirstChunk  int                `bson:"first_chunk" json:"first_chunk"`
+	LastChunk   int                `bson:"last_chunk" json:"last_chunk"`
+	TargetWords int                `bson:"target_words" json:"target_words,omitempty"` // only set on final summaries
+	Model       string             `bson:"model" json:"model"`
+	Text        string             `bson:"text" json:"text"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type SummarizeRequest struct {
+	ChapterFrom int  `json:"chapter_from,omitempty"`
+	ChapterTo   int  `json:"chapter_to,omitempty"`
+	TargetWords int  `json:"target_words,omitempty"` // approximate length of the final summary
+	Refresh     bool `json:"refresh,omitempty"`      // ignore cached summaries and regenerate them
+}
+
+type SummarizeResponse struct {
+	BookID           string `json:"book_id"`
+	Summary          string `json:"summary"`
+	ChapterFrom      int    `json:"chapter_from,omitempty"`
+	ChapterTo        int    `json:"chapter_to,omitempty"`
+	TargetWords      int    `json:"target_words"`
+	Chunks           int    `json:"chunks"`
+	Levels           int    `json:"levels"`
+	Sections         int    `json:"sections"`        // summaries produced or reused across all levels
+	CachedSections   int    `json:"cached_sections"` // of those, how many came from the cache
+	Model            string `json:"model"`
+	ProcessingTimeMs int64  `json:"processing_time_ms"`
+}
+
+// BookSearchResult is one book's best chunks for a query and how all its chunks scored
+// the mean and standard deviation let scores be compared across books of different lengths
+type BookSearchResult struct {
+	BookID  string
+	Results []SearchResult
+	Scanned int
+	Mean    float64
+	StdDev  float64
 }
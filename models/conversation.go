@@ -0,0 +1,60 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Conversation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	BookID    string             `bson:"book_id" json:"book_id"`
+	Title     string             `bson:"title" json:"title"`
+	Messages  []Message          `bson:"messages" json:"messages,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type Message struct {
+	Role    string `bson:"role" json:"role"` // "user" or "assistant"
+	Content string `bson:"content" json:"content"`
+	// the follow-up rewritten into a self-contained question, used for retrieval
+	StandaloneQuestion string        `bson:"standalone_question,omitempty" json:"standalone_question,omitempty"`
+	Sources            []SourceChunk `bson:"sources,omitempty" json:"sources,omitempty"`
+	CreatedAt          time.Time     `bson:"created_at" json:"created_at"`
+}
+
+type CreateConversationRequest struct {
+	BookID string `json:"book_id" binding:"required"`
+	Title  string `json:"title,omitempty"`
+}
+
+type UpdateConversationRequest struct {
+	Title string `json:"title" binding:"required"`
+}
+
+type ConversationMessageRequest struct {
+	Question       string            `json:"question" binding:"required"`
+	TopK           int               `json:"top_k,omitempty"`
+	PromptTemplate string            `json:"prompt_template,omitempty"`
+	Model          string            `json:"model,omitempty"`
+	Options        GenerationOptions `json:"options,omitempty"`
+	Strict         bool              `json:"strict,omitempty"`
+	VerifyWithLLM  bool              `json:"verify_with_llm,omitempty"`
+}
+
+type ConversationMessageResponse struct {
+	ConversationID       string            `json:"conversation_id"`
+	Answer               string            `json:"answer"`
+	StandaloneQuestion   string            `json:"standalone_question"`
+	Segments             []AnswerSegment   `json:"segments"`
+	Citations            []Citation        `json:"citations"`
+	Sources              []SourceChunk     `json:"sources"`
+	DroppedSources       []SourceChunk     `json:"dropped_sources"`
+	ProcessingTimeMs     int64             `json:"processing_time_ms"`
+	Model                string            `json:"model"`
+	Options              GenerationOptions `json:"options"`
+	GroundedScore        *float64          `json:"grounded_score,omitempty"`
+	UnsupportedSentences []string          `json:"unsupported_sentences,omitempty"`
+	Refused              bool              `json:"refused,omitempty"`
+}
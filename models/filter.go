@@ -0,0 +1,23 @@
+package models
+
+// ChunkFilter restricts retrieval to chunks whose metadata matches every field that is set
+type ChunkFilter struct {
+	Author string `json:"author,omitempty"` // case-insensitive exact match
+	Title  string `json:"title,omitempty"`  // case-insensitive exact match
+	// detected chapter number and offsets into the book, bounds are inclusive
+	// offsets are bytes of the text after whitespace normalisation rather than characters,
+	// and chunks stored before offsets were recorded never match them
+	Chapter    *IntRange `json:"chapter,omitempty"`
+	Characters *IntRange `json:"characters,omitempty"`
+	Tags       []string  `json:"tags,omitempty"` // chunks carrying all of these tags
+	// upload time, RFC 3339 or YYYY-MM-DD
+	UploadedAfter  string `json:"uploaded_after,omitempty"`
+	UploadedBefore string `json:"uploaded_before,omitempty"`
+	// version of the book to search, the current one when 0
+	Version int `json:"version,omitempty"`
+}
+
+type IntRange struct {
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+}
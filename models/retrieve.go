@@ -0,0 +1,49 @@
+package models
+
+// RetrieveRequest runs retrieval on its own, without generating an answer
+type RetrieveRequest struct {
+	Question string       `json:"question" binding:"required"`
+	BookID   string       `json:"book_id,omitempty"` // all books when empty
+	TopK     int          `json:"top_k,omitempty"`
+	Filter   *ChunkFilter `json:"filter,omitempty"`
+}
+
+type RetrieveResponse struct {
+	Question       string `json:"question"`
+	BookID         string `json:"book_id,omitempty"`
+	TopK           int    `json:"top_k"`
+	EmbeddingModel string `json:"embedding_model"`
+	EmbeddingDim   int    `json:"embedding_dim"`
+	// L2 norm of the query embedding, near zero when few of the query's words are known to the embedder
+	QueryNorm     float64          `json:"query_norm"`
+	ChunksScanned int              `json:"chunks_scanned"`
+	ChunksSkipped int              `json:"chunks_skipped"` // embedded with a different dimension
+	Results       []RetrievedChunk `json:"results"`
+	Timings       RetrievalTimings `json:"timings"`
+}
+
+type RetrievedChunk struct {
+	Rank       int            `json:"rank"`
+	ChunkID    string         `json:"chunk_id"`
+	BookID     string         `json:"book_id"`
+	ChunkIndex int            `json:"chunk_index"`
+	Text       string         `json:"text"`
+	Metadata   ChunkMetadata  `json:"metadata"`
+	Score      float64        `json:"score"` // the score the chunk was ranked by
+	Breakdown  ScoreBreakdown `json:"breakdown"`
+}
+
+// ScoreBreakdown splits a score into the stages that produced it
+// stages retrieval doesn't run are null
+type ScoreBreakdown struct {
+	Vector  float64  `json:"vector"` // cosine similarity with the query
+	Keyword *float64 `json:"keyword"`
+	Rerank  *float64 `json:"rerank"`
+}
+
+type RetrievalTimings struct {
+	EmbedMs int64 `json:"embed_ms"` // looking up the book's model and embedding the query
+	FetchMs int64 `json:"fetch_ms"` // loading the candidate chunks
+	ScoreMs int64 `json:"score_ms"` // scoring and ranking them
+	TotalMs int64 `json:"total_ms"`
+}
@@ -1,10 +1,18 @@
 package services
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
+
+	"github.com/blavejr/bowattAI/models"
 )
 
 type Chunker struct {
@@ -19,128 +27,150 @@ func NewChunker(chunkSize, chunkOverlap int) *Chunker {
 	}
 }
 
-func (c *Chunker) ChunkText(text string) []string {
-	log.Printf("Starting text chunking (input length: %d, chunk size: %d, overlap: %d)", len(text), c.ChunkSize, c.ChunkOverlap)
-	startTime := time.Now()
-
-	log.Printf("Cleaning text...")
-	text = cleanText(text)
+// ChunkSpan is a chunk with its position in the cleaned text
+type ChunkSpan struct {
+	Text  string
+	Start int
+	End   int
+}
 
-	if len(text) == 0 {
-		log.Printf("Text is empty after cleaning")
-		return []string{}
-	}
+// ChunkSpans splits text into chunks and records where each chunk starts and ends
+func (c *Chunker) ChunkSpans(text string) []ChunkSpan {
+	chunks := []ChunkSpan{}
+	// reading from a string can't fail and collecting never does
+	_ = c.ChunkReader(strings.NewReader(text), func(span ChunkSpan) error {
+		chunks = append(chunks, span)
+		return nil
+	})
+	return chunks
+}
 
-	if len(text) <= c.ChunkSize {
-		log.Printf("Text is smaller than chunk size, returning as single chunk")
-		return []string{text}
-	}
+// ChunkReader splits the text read from r into chunks, calling emit for each in order
+// the text is cleaned as it is read and only about one chunk of it is held in memory,
+// so it works for files of any size; offsets are into the cleaned text as with ChunkSpans
+func (c *Chunker) ChunkReader(r io.Reader, emit func(ChunkSpan) error) error {
+	log.Printf("Starting text chunking (chunk size: %d, overlap: %d)", c.ChunkSize, c.ChunkOverlap)
+	startTime := time.Now()
 
-	log.Printf("Splitting text into chunks...")
-	chunks := []string{}
-	start := 0
-	chunkCount := 0
-	iteration := 0
-	minChunkSize := c.ChunkSize - c.ChunkOverlap
-	if minChunkSize <= 0 {
-		minChunkSize = 1
-	}
-	maxIterations := (len(text) / minChunkSize) + 1000
-	log.Printf("Max iterations set to %d (text length: %d, min chunk size: %d)", maxIterations, len(text), minChunkSize)
+	cleaner := newTextCleaner(r)
+	var window []byte // cleaned text from base onwards
+	base, start := 0, 0
+	eof := false
+	chunkCount, totalSize := 0, 0
+
+	for {
+		// keep the rest of the chunk and one byte past it buffered, enough to find a sentence boundary
+		if need := start - base + c.ChunkSize + 1; !eof && len(window) < need {
+			var err error
+			window, eof, err = cleaner.fill(window, need)
+			if err != nil {
+				return fmt.Errorf("failed to read text: %w", err)
+			}
+		}
 
-	for start < len(text) {
-		iteration++
-		if iteration > maxIterations {
-			log.Printf("ERROR: Exceeded max iterations (%d). Loop may be infinite! start=%d, len(text)=%d, chunks created=%d", maxIterations, start, len(text), len(chunks))
+		text := string(window)
+		relStart := start - base
+		if relStart >= len(text) {
 			break
 		}
 
-		log.Printf("Iteration %d: start=%d, remaining=%d", iteration, start, len(text)-start)
-
-		// Calculate end position
-		end := start + c.ChunkSize
+		end := relStart + c.ChunkSize
 		if end > len(text) {
 			end = len(text)
 		}
-		log.Printf("Calculated end position: %d", end)
 
 		// Try to break at sentence boundary if not at end of text
+		// Only use sentence boundary if it's far enough ahead to allow progress after overlap
 		if end < len(text) {
-			log.Printf("Looking for sentence boundary between %d and %d...", start, end)
-			sentenceBoundaryStart := time.Now()
-			sentenceEnd := findSentenceBoundary(text, start, end)
-			sentenceBoundaryTime := time.Since(sentenceBoundaryStart)
-			log.Printf("Sentence boundary search took %v, found at: %d", sentenceBoundaryTime, sentenceEnd)
-			// Only use sentence boundary if it's far enough ahead to allow progress after overlap
-			// We need: sentenceEnd - overlap > start, which means sentenceEnd > start + overlap
-			if sentenceEnd > start+c.ChunkOverlap {
+			if sentenceEnd := findSentenceBoundary(text, relStart, end); sentenceEnd > relStart+c.ChunkOverlap {
 				end = sentenceEnd
-				log.Printf("Updated end to sentence boundary: %d", end)
-			} else {
-				log.Printf("Sentence boundary too close (would cause no progress), using calculated end: %d", end)
 			}
 		}
 
-		log.Printf("Extracting chunk from %d to %d...", start, end)
-		chunk := strings.TrimSpace(text[start:end])
+		chunk := strings.TrimSpace(text[relStart:end])
 		if len(chunk) > 0 {
-			chunks = append(chunks, chunk)
+			chunkStart := base + relStart + strings.Index(text[relStart:end], chunk)
+			if err := emit(ChunkSpan{Text: chunk, Start: chunkStart, End: chunkStart + len(chunk)}); err != nil {
+				return err
+			}
 			chunkCount++
-			log.Printf("Added chunk %d (length: %d)", chunkCount, len(chunk))
-		} else {
-			log.Printf("Chunk is empty after trimming, skipping")
+			totalSize += len(chunk)
 		}
 
-		oldStart := start
-		start = end - c.ChunkOverlap
-		if start < 0 {
-			start = 0
+		// the window only stops short of a chunk past start at the end of the text
+		if end == len(text) {
+			break
 		}
 
 		// Ensure we always make progress, if overlap would cause us to go backwards or stay same, advance by at least 1
-		if start <= oldStart {
-			start = oldStart + 1
-			log.Printf("Overlap would cause no progress, forcing start to advance: %d -> %d", oldStart, start)
-		} else {
-			log.Printf("Moving start: %d -> %d (overlap: %d)", oldStart, start, c.ChunkOverlap)
+		next := end - c.ChunkOverlap
+		if next <= relStart {
+			next = relStart + 1
 		}
+		start = base + next
 
-		// Prevent infinite loop
-		if start >= end {
-			log.Printf("Loop prevention: start (%d) >= end (%d), breaking", start, end)
-			break
-		}
-
-		// Safety check: if we've reached the end of text, break
-		if start >= len(text) {
-			log.Printf("Reached end of text at position %d", start)
-			break
-		}
+		// drop the text before the next chunk so the buffer stays about a chunk long
+		window = append(window[:0], window[next:]...)
+		base = start
 	}
 
-	chunkTime := time.Since(startTime)
 	avgChunkSize := 0
-	if len(chunks) > 0 {
-		avgChunkSize = len(text) / len(chunks)
+	if chunkCount > 0 {
+		avgChunkSize = totalSize / chunkCount
 	}
-	log.Printf("Created %d chunks in %v (avg chunk size: %d chars)", len(chunks), chunkTime, avgChunkSize)
-	return chunks
+	log.Printf("Created %d chunks in %v (avg chunk size: %d chars)", chunkCount, time.Since(startTime), avgChunkSize)
+	return nil
 }
 
-// cleanText removes excessive whitespace and normalizes text
-func cleanText(text string) string {
-	lines := strings.Split(text, "\n")
-	var cleanedLines []string
+// textCleaner reads text with runs of whitespace collapsed to single spaces and no leading or trailing space
+// line breaks count as whitespace, so chunks flow across lines and paragraphs
+type textCleaner struct {
+	r       *bufio.Reader
+	space   bool // whitespace since the last word was written
+	started bool
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line != "" {
-			line = strings.Join(strings.Fields(line), " ")
-			cleanedLines = append(cleanedLines, line)
+func newTextCleaner(r io.Reader) *textCleaner {
+	return &textCleaner{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// append cleaned text to buf until it is at least want bytes long or the text ends
+func (t *textCleaner) fill(buf []byte, want int) ([]byte, bool, error) {
+	for len(buf) < want {
+		r, size, err := t.r.ReadRune()
+		if err == io.EOF {
+			return buf, true, nil
+		}
+		if err != nil {
+			return buf, false, err
+		}
+
+		if unicode.IsSpace(r) {
+			t.space = true
+			continue
 		}
+		if t.space && t.started {
+			buf = append(buf, ' ')
+		}
+		t.space = false
+		t.started = true
+
+		// keep invalid bytes as they are rather than replacing them
+		if r == utf8.RuneError && size == 1 {
+			_ = t.r.UnreadRune()
+			b, _ := t.r.ReadByte()
+			buf = append(buf, b)
+			continue
+		}
+		buf = utf8.AppendRune(buf, r)
 	}
+	return buf, false, nil
+}
 
-	return strings.Join(cleanedLines, " ")
+// cleanText removes excessive whitespace and normalizes text
+func cleanText(text string) string {
+	cleaned, _, _ := newTextCleaner(strings.NewReader(text)).fill(nil, len(text)+1)
+	return string(cleaned)
 }
 
 func findSentenceBoundary(text string, start, end int) int {
@@ -198,6 +228,55 @@ func findSentenceBoundary(text string, start, end int) int {
 	return end
 }
 
+// matches headings like "CHAPTER 12" or "Chapter IV", lowercase "chapter" is usually prose
+var chapterPattern = regexp.MustCompile(`\b(?:CHAPTER|Chapter)\s+([0-9]+|[IVXLC]+)\b`)
+
+// how far ahead a heading may jump, to survive a heading split across two chunks
+const maxChapterGap = 3
+
+// ChapterDetector finds the chapter of each chunk of a book as the chunks stream in, and counts them
+// only headings shortly after the current chapter are accepted, so references like "see Chapter 40"
+// are ignored, and chapter 1 restarts the count so a table of contents doesn't swallow the book
+type ChapterDetector struct {
+	current int
+	count   models.ChapterCount
+}
+
+// Next returns the chapter of the next chunk of the book, 0 before the first heading
+func (d *ChapterDetector) Next(chunk string) int {
+	for _, match := range chapterPattern.FindAllStringSubmatch(chunk, -1) {
+		if n := parseChapterNumber(match[1]); (n > d.current && n <= d.current+maxChapterGap) || n == 1 {
+			d.current = n
+		}
+	}
+	d.count.Add(d.current)
+	return d.current
+}
+
+// Chapters is the number of chapters detected so far
+func (d *ChapterDetector) Chapters() int {
+	return d.count.Chapters
+}
+
+func parseChapterNumber(s string) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+
+	values := map[rune]int{'i': 1, 'v': 5, 'x': 10, 'l': 50, 'c': 100}
+	runes := []rune(strings.ToLower(s))
+	total := 0
+	for i, r := range runes {
+		v := values[r]
+		if i+1 < len(runes) && values[runes[i+1]] > v {
+			total -= v
+		} else {
+			total += v
+		}
+	}
+	return total
+}
+
 // GetChunkMetrics returns statistics about chunking
 type ChunkMetrics struct {
 	TotalChunks  int
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const chunkerSample = "The cat sat on the mat.  The dog ran far away!\n\nA bird sang loudly today? Yes it did."
+
+func TestChunkSpansBoundaries(t *testing.T) {
+	tests := []struct {
+		size, overlap int
+		want          []ChunkSpan
+	}{
+		{30, 0, []ChunkSpan{
+			{Text: "The cat sat on the mat.", Start: 0, End: 23},
+			{Text: "The dog ran far away!", Start: 24, End: 45},
+			{Text: "A bird sang loudly today?", Start: 46, End: 71},
+			{Text: "Yes it did.", Start: 72, End: 83},
+		}},
+		// the second chunk starts overlap bytes before the first ends and runs to the end, nothing follows it
+		{64, 16, []ChunkSpan{
+			{Text: "The cat sat on the mat. The dog ran far away!", Start: 0, End: 45},
+			{Text: "og ran far away! A bird sang loudly today? Yes it did.", Start: 29, End: 83},
+		}},
+	}
+
+	for _, tt := range tests {
+		got := NewChunker(tt.size, tt.overlap).ChunkSpans(chunkerSample)
+		if len(got) != len(tt.want) {
+			t.Errorf("size %d overlap %d: got %d chunks %q, want %d", tt.size, tt.overlap, len(got), got, len(tt.want))
+			continue
+		}
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("size %d overlap %d: chunk %d = %+v, want %+v", tt.size, tt.overlap, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestChunkSpansSingleChunk(t *testing.T) {
+	got := NewChunker(1000, 100).ChunkSpans(chunkerSample)
+	cleaned := cleanText(chunkerSample)
+	if len(got) != 1 || got[0].Text != cleaned || got[0].Start != 0 || got[0].End != len(cleaned) {
+		t.Errorf("chunks = %+v, want the whole cleaned text as one chunk", got)
+	}
+}
+
+// spans point into the cleaned text, start in order, and the last one ends with the text
+func TestChunkSpansOffsets(t *testing.T) {
+	text := strings.Repeat(chunkerSample+"\n", 20)
+	cleaned := cleanText(text)
+
+	for _, chunker := range []*Chunker{NewChunker(30, 0), NewChunker(30, 10), NewChunker(100, 20), NewChunker(7, 3)} {
+		spans := chunker.ChunkSpans(text)
+		if len(spans) == 0 {
+			t.Fatalf("size %d overlap %d: no chunks", chunker.ChunkSize, chunker.ChunkOverlap)
+		}
+		for i, span := range spans {
+			if cleaned[span.Start:span.End] != span.Text {
+				t.Errorf("size %d overlap %d: chunk %d is %q but its span covers %q", chunker.ChunkSize, chunker.ChunkOverlap, i, span.Text, cleaned[span.Start:span.End])
+			}
+			if i > 0 && span.Start <= spans[i-1].Start {
+				t.Errorf("size %d overlap %d: chunk %d starts at %d, not after chunk %d at %d", chunker.ChunkSize, chunker.ChunkOverlap, i, span.Start, i-1, spans[i-1].Start)
+			}
+		}
+		if last := spans[len(spans)-1]; last.End != len(cleaned) {
+			t.Errorf("size %d overlap %d: last chunk ends at %d, want %d", chunker.ChunkSize, chunker.ChunkOverlap, last.End, len(cleaned))
+		}
+		// only the last chunk reaches the end of the text
+		for i, span := range spans[:len(spans)-1] {
+			if span.End == len(cleaned) {
+				t.Errorf("size %d overlap %d: chunk %d already ends with the text", chunker.ChunkSize, chunker.ChunkOverlap, i)
+			}
+		}
+
+		// without overlap the chunks cover the text once
+		if chunker.ChunkOverlap == 0 {
+			texts := make([]string, len(spans))
+			for i, span := range spans {
+				texts[i] = span.Text
+			}
+			if joined := strings.Join(texts, " "); joined != cleaned {
+				t.Errorf("size %d: chunks joined = %q, want the cleaned text", chunker.ChunkSize, joined)
+			}
+		}
+	}
+}
+
+// streaming the text in small reads gives the same chunks as chunking it at once
+func TestChunkReaderMatchesChunkSpans(t *testing.T) {
+	text := strings.Repeat(chunkerSample+"\r\n\tCHAPTER 2 été ", 50)
+	chunker := NewChunker(64, 16)
+	want := chunker.ChunkSpans(text)
+
+	var got []ChunkSpan
+	err := chunker.ChunkReader(iotest.OneByteReader(strings.NewReader(text)), func(span ChunkSpan) error {
+		got = append(got, span)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChunkReader: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("chunk %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	text := "  The cat\r\nsat.\n\n\tThe  dog ran. "
+	want := ContentHash("The cat sat. The dog ran.")
+	if got := ContentHash(text); got != want {
+		t.Errorf("ContentHash ignores whitespace differences: got %s, want %s", got, want)
+	}
+
+	got, err := ContentHashReader(iotest.OneByteReader(strings.NewReader(text)))
+	if err != nil {
+		t.Fatalf("ContentHashReader: %v", err)
+	}
+	if got != want {
+		t.Errorf("ContentHashReader = %s, want ContentHash %s", got, want)
+	}
+
+	if ContentHash("The cat sat.") == ContentHash("The cat sat!") {
+		t.Error("different texts have the same hash")
+	}
+}
+
+func TestChunkHashMatchesVersionChunks(t *testing.T) {
+	// a chunk that didn't change between versions hashes the same, wherever it is
+	chunker := NewChunker(30, 0)
+	before := chunker.ChunkSpans(chunkerSample)
+	after := chunker.ChunkSpans("A new first sentence here. " + chunkerSample)
+
+	hashes := make(map[string]bool)
+	for _, span := range before {
+		hashes[ChunkHash(span.Text)] = true
+	}
+	for _, span := range after[1:] {
+		if !hashes[ChunkHash(span.Text)] {
+			t.Errorf("chunk %q of the new version has no matching hash in the old one", span.Text)
+		}
+	}
+	if hashes[ChunkHash(after[0].Text)] {
+		t.Errorf("new chunk %q matches an old hash", after[0].Text)
+	}
+}
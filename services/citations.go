@@ -0,0 +1,137 @@
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// matches [1], [2, 3] and [2][3]
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// ParseCitations splits an answer into sentences and resolves the [n] markers of each one
+// to the chunk IDs of the passages given to the generator (sourceIDs[n-1])
+// markers pointing to passages that don't exist are reported as invalid
+func ParseCitations(answer string, sourceIDs []string) ([]models.AnswerSegment, []models.Citation) {
+	segments := []models.AnswerSegment{}
+	citations := []models.Citation{}
+	seen := map[int]bool{}
+
+	for _, sentence := range splitSentences(answer) {
+		segment := models.AnswerSegment{
+			Citations: []int{},
+			ChunkIDs:  []string{},
+		}
+		cited := map[int]bool{}
+
+		for _, match := range citationPattern.FindAllStringSubmatch(sentence, -1) {
+			for _, part := range strings.Split(match[1], ",") {
+				marker, err := strconv.Atoi(strings.TrimSpace(part))
+				if err != nil || cited[marker] {
+					continue
+				}
+				cited[marker] = true
+
+				valid := marker >= 1 && marker <= len(sourceIDs)
+				if valid {
+					segment.Citations = append(segment.Citations, marker)
+					segment.ChunkIDs = append(segment.ChunkIDs, sourceIDs[marker-1])
+				} else {
+					segment.InvalidCitations = append(segment.InvalidCitations, marker)
+				}
+
+				if !seen[marker] {
+					seen[marker] = true
+					citation := models.Citation{Marker: marker, Valid: valid}
+					if valid {
+						citation.ChunkID = sourceIDs[marker-1]
+					}
+					citations = append(citations, citation)
+				}
+			}
+		}
+
+		segment.Text = stripCitations(sentence)
+		if segment.Text == "" {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, citations
+}
+
+// words ending in a period that don't end a sentence
+var abbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "st": true,
+	"jr": true, "sr": true, "vs": true, "e.g": true, "i.e": true,
+}
+
+// split text after sentence enders, keeping markers that trail the punctuation ("... end. [1]")
+// with the sentence they follow
+func splitSentences(text string) []string {
+	sentences := []string{}
+	runes := []rune(text)
+	start := 0
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '.' && runes[i] != '!' && runes[i] != '?' && runes[i] != '\n' {
+			continue
+		}
+		if runes[i] != '\n' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && runes[i+1] != '[' {
+			continue // "Mr.Darcy", "3.5"
+		}
+		if runes[i] == '.' && isAbbreviation(runes[start:i]) {
+			continue
+		}
+
+		end := i + 1
+		// absorb trailing citation markers
+		for {
+			j := end
+			for j < len(runes) && runes[j] == ' ' {
+				j++
+			}
+			loc := citationPattern.FindStringIndex(string(runes[j:]))
+			if loc == nil || loc[0] != 0 {
+				break
+			}
+			end = j + len([]rune(string(runes[j:])[:loc[1]]))
+		}
+
+		if sentence := strings.TrimSpace(string(runes[start:end])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = end
+		i = end - 1
+	}
+
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
+
+func isAbbreviation(before []rune) bool {
+	word := before
+	for k := len(before) - 1; k >= 0; k-- {
+		if unicode.IsSpace(before[k]) {
+			word = before[k+1:]
+			break
+		}
+	}
+	return abbreviations[strings.ToLower(string(word))]
+}
+
+// remove the markers and the space left before punctuation
+func stripCitations(sentence string) string {
+	text := citationPattern.ReplaceAllString(sentence, "")
+	text = strings.Join(strings.Fields(text), " ")
+	for _, p := range []string{".", ",", "!", "?", ";", ":"} {
+		text = strings.ReplaceAll(text, " "+p, p)
+	}
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// TrimHistory keeps the most recent messages that fit in the token budget
+func TrimHistory(messages []models.Message, budget int) []models.Message {
+	if budget <= 0 {
+		return nil
+	}
+
+	used := 0
+	start := len(messages)
+	for i := len(messages) - 1; i >= 0; i-- {
+		tokens := EstimateTokens(messages[i].Content) + 4 // role label and separators
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		start = i
+	}
+
+	return messages[start:]
+}
+
+// RewriteQuestion turns a follow-up like "what did she do next?" into a standalone question
+// using the conversation history, falls back to the original question on failure
+func (g *Generator) RewriteQuestion(question string, history []models.Message) string {
+	if len(history) == 0 {
+		return question
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Given the following conversation about a book and a follow-up question, rewrite the follow-up question ")
+	sb.WriteString("as a standalone question that can be understood without the conversation.\n")
+	sb.WriteString("Replace pronouns and vague references with the names and things they refer to.\n")
+	sb.WriteString("If the question is already standalone, return it unchanged. Return ONLY the question.\n\n")
+	sb.WriteString("Conversation:\n")
+	writeHistory(&sb, history)
+	sb.WriteString(fmt.Sprintf("\nFollow-up question: %s\n\n", question))
+	sb.WriteString("Standalone question:")
+
+	rewritten, err := g.GenerateWithCustomPrompt(sb.String())
+	if err != nil {
+		return question
+	}
+
+	rewritten = strings.Trim(strings.TrimSpace(rewritten), "\"")
+	// small models sometimes answer instead of rewriting, only accept a single line
+	if rewritten == "" || strings.Contains(rewritten, "\n") {
+		return question
+	}
+	return rewritten
+}
+
+func writeHistory(sb *strings.Builder, history []models.Message) {
+	for _, message := range history {
+		role := "User"
+		if message.Role == "assistant" {
+			role = "Assistant"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", role, message.Content))
+	}
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// most sub-questions a question is split into
+const maxSubQuestions = 4
+
+// "1. ...", "2) ...", "- ..." list items in the LLM's reply
+var listItemPattern = regexp.MustCompile(`^\s*(?:\d+[.)]|[-*•])\s*`)
+
+// Decomposer answers questions that need evidence from several places in a book
+// 1. Asking the LLM to split the question into simpler sub-questions
+// 2. Retrieving chunks for each sub-question
+// 3. Merging the evidence, keeping each chunk once with its best score
+type Decomposer struct {
+	generator *Generator
+	retriever *Retriever
+}
+
+func NewDecomposer(generator *Generator, retriever *Retriever) *Decomposer {
+	return &Decomposer{
+		generator: generator,
+		retriever: retriever,
+	}
+}
+
+// Decomposition is the merged evidence for a question and how it was gathered
+type Decomposition struct {
+	Results []models.SearchResult // merged chunks, each with its best score
+	Steps   []models.DecompositionStep
+}
+
+// Gather splits the question and retrieves evidence for every part
+func (d *Decomposer) Gather(ctx context.Context, question string, topK int, bookID string, filter *models.ChunkFilter) (*Decomposition, error) {
+	subQuestions, err := d.Split(ctx, question)
+	if err != nil {
+		log.Printf("Failed to decompose question, retrieving for it as a whole: %v", err)
+		subQuestions = []string{question}
+	}
+
+	decomposition := &Decomposition{}
+	var perStep [][]models.SearchResult
+	best := make(map[string]float64)
+	for _, subQuestion := range subQuestions {
+		results, err := d.retriever.RetrieveFiltered(ctx, subQuestion, topK, bookID, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve for %q: %w", subQuestion, err)
+		}
+
+		step := models.DecompositionStep{
+			SubQuestion: subQuestion,
+			ChunkIDs:    make([]string, 0, len(results)),
+			Scores:      make([]float64, 0, len(results)),
+		}
+		for _, result := range results {
+			id := result.Chunk.ID.Hex()
+			step.ChunkIDs = append(step.ChunkIDs, id)
+			step.Scores = append(step.Scores, result.Score)
+
+			score, seen := best[id]
+			if !seen {
+				step.NewChunks++
+			}
+			if !seen || result.Score > score {
+				best[id] = result.Score
+			}
+		}
+		decomposition.Steps = append(decomposition.Steps, step)
+		perStep = append(perStep, results)
+	}
+
+	// take each sub-question's best chunks in turn, so packing to the context budget
+	// doesn't leave a sub-question without evidence
+	included := make(map[string]bool)
+	for rank := 0; rank < topK; rank++ {
+		for _, results := range perStep {
+			if rank >= len(results) {
+				continue
+			}
+			result := results[rank]
+			id := result.Chunk.ID.Hex()
+			if included[id] {
+				continue
+			}
+			included[id] = true
+			result.Score = best[id]
+			decomposition.Results = append(decomposition.Results, result)
+		}
+	}
+
+	log.Printf("Decomposed into %d sub-questions, %d distinct chunks", len(subQuestions), len(decomposition.Results))
+	return decomposition, nil
+}
+
+// Split asks the LLM for the simpler questions whose answers together answer the question
+func (d *Decomposer) Split(ctx context.Context, question string) ([]string, error) {
+	var sb strings.Builder
+	sb.WriteString("Break the following question about a book into simpler questions that can each be answered from a single passage of the book. ")
+	sb.WriteString(fmt.Sprintf("Write between 2 and %d questions, one per line, as a numbered list, and nothing else.\n\n", maxSubQuestions))
+	sb.WriteString(fmt.Sprintf("Question: %s\n\nSimpler questions:", question))
+
+	response, err := d.generator.CompletePrompt(ctx, sb.String())
+	if err != nil {
+		return nil, err
+	}
+
+	subQuestions := parseSubQuestions(response, maxSubQuestions)
+	if len(subQuestions) == 0 {
+		return nil, fmt.Errorf("no sub-questions in response %q", response)
+	}
+	return subQuestions, nil
+}
+
+// one question per non-empty line, without list markers or duplicates, at most limit
+func parseSubQuestions(response string, limit int) []string {
+	var subQuestions []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(listItemPattern.ReplaceAllString(line, ""))
+		line = strings.Trim(line, `"*`)
+		// skip headings like "Simpler questions:"
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		key := strings.ToLower(line)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		subQuestions = append(subQuestions, line)
+		if len(subQuestions) == limit {
+			break
+		}
+	}
+	return subQuestions
+}
@@ -1,82 +1,95 @@
 package services
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/blavejr/bowattAI/config"
 )
 
-// handle embedding generation via Ollama
+// handle embedding generation via an EmbeddingProvider (Ollama, OpenAI-compatible)
+// the "simple" model is computed locally and never reaches the provider
 type Embedder struct {
-	BaseURL string
-	Model   string
-	Client  *http.Client
+	Provider EmbeddingProvider
+	Model    string
+	Prefixes map[string]config.EmbeddingPrefix
 }
 
-func NewEmbedder(baseURL, model string) *Embedder {
+func NewEmbedder(provider EmbeddingProvider, model string, prefixes map[string]config.EmbeddingPrefix) *Embedder {
 	return &Embedder{
-		BaseURL: baseURL,
-		Model:   model,
-		Client: &http.Client{
-			Timeout: 60 * time.Second,
-		},
+		Provider: provider,
+		Model:    model,
+		Prefixes: prefixes,
 	}
 }
 
-type OllamaEmbedRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-}
+// EmbeddingTask tells asymmetric models whether text is a search query or a stored passage
+type EmbeddingTask int
 
-type OllamaEmbedResponse struct {
-	Embedding []float32 `json:"embedding"`
-}
+const (
+	TaskQuery EmbeddingTask = iota
+	TaskDocument
+)
 
-func (e *Embedder) GenerateEmbedding(text string) ([]float32, error) {
-	if e.Model == "simple" {
-		return e.generateSimpleEmbedding(text), nil
+// apply the model's prefix template for the task, e.g. "search_query: " for nomic-embed-text
+func (e *Embedder) formatText(text, model string, task EmbeddingTask) string {
+	prefix, ok := e.Prefixes[model]
+	if !ok {
+		// "nomic-embed-text:latest" uses the same prefixes as "nomic-embed-text"
+		if name, _, found := strings.Cut(model, ":"); found {
+			prefix, ok = e.Prefixes[name]
+		}
 	}
-
-	// else use the ollama api
-	reqBody := OllamaEmbedRequest{
-		Model:  e.Model,
-		Prompt: text,
+	if !ok {
+		return text
 	}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	template := prefix.Query
+	if task == TaskDocument {
+		template = prefix.Document
 	}
-
-	// make request to ollama
-	url := fmt.Sprintf("%s/api/embeddings", e.BaseURL)
-	resp, err := e.Client.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to call Ollama API: %w", err)
+	if strings.Contains(template, "{text}") {
+		return strings.ReplaceAll(template, "{text}", text)
 	}
-	defer resp.Body.Close()
+	return template + text
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("ollama API error (status %d): %s", resp.StatusCode, string(body))
+// embed a search query with the given model (empty for the configured one)
+func (e *Embedder) EmbedQuery(text, model string) ([]float32, error) {
+	if model == "" {
+		model = e.Model
 	}
+	return e.GenerateEmbeddingWithModel(e.formatText(text, model, TaskQuery), model)
+}
 
-	var embedResp OllamaEmbedResponse
-	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+// embed a book passage with the given model (empty for the configured one)
+func (e *Embedder) EmbedDocument(text, model string) ([]float32, error) {
+	if model == "" {
+		model = e.Model
 	}
+	return e.GenerateEmbeddingWithModel(e.formatText(text, model, TaskDocument), model)
+}
+
+// embed raw text with the configured model, no task prefix is applied
+func (e *Embedder) GenerateEmbedding(text string) ([]float32, error) {
+	return e.GenerateEmbeddingWithModel(text, e.Model)
+}
 
-	if len(embedResp.Embedding) == 0 {
-		return nil, fmt.Errorf("received empty embedding from ollama")
+// embed text with a specific model, used to query books indexed with an older model
+func (e *Embedder) GenerateEmbeddingWithModel(text, model string) ([]float32, error) {
+	if model == "" {
+		model = e.Model
+	}
+	if model == "simple" {
+		return e.generateSimpleEmbedding(text), nil
 	}
 
-	return embedResp.Embedding, nil
+	// else use the provider api
+	return e.Provider.Embed(context.Background(), model, text)
 }
 
 // generateSimpleEmbedding creates a lightweight embedding using word frequency
@@ -149,6 +162,7 @@ func (e *Embedder) GenerateEmbeddings(texts []string) ([][]float32, error) {
 	return embeddings, nil
 }
 
+// embed book passages, applying the model's document prefix
 func (e *Embedder) GenerateEmbeddingsBatch(texts []string, batchSize int) ([][]float32, error) {
 	log.Printf("Starting batch embedding generation for %d texts (model: %s)", len(texts), e.Model)
 	startTime := time.Now()
@@ -170,7 +184,7 @@ func (e *Embedder) GenerateEmbeddingsBatch(texts []string, batchSize int) ([][]f
 
 				// generate embedding no api call, just computation
 				embedStart := time.Now()
-				embedding := e.generateSimpleEmbedding(texts[idx])
+				embedding := e.generateSimpleEmbedding(e.formatText(texts[idx], e.Model, TaskDocument))
 				embedDuration := time.Since(embedStart)
 
 				mu.Lock()
@@ -205,7 +219,7 @@ func (e *Embedder) GenerateEmbeddingsBatch(texts []string, batchSize int) ([][]f
 
 		log.Printf("Generating embedding %d/%d...", i+1, len(texts))
 		embedStart := time.Now()
-		embedding, err := e.GenerateEmbedding(texts[i])
+		embedding, err := e.EmbedDocument(texts[i], e.Model)
 		embedDuration := time.Since(embedStart)
 		if err != nil {
 			log.Printf("Failed to generate embedding for chunk %d: %v", i, err)
@@ -232,19 +246,7 @@ func (e *Embedder) TestConnection() error {
 		return nil
 	}
 
-	// test ollama connection
-	url := fmt.Sprintf("%s/api/tags", e.BaseURL)
-	resp, err := e.Client.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to connect to Ollama: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("ollama API returned status %d", resp.StatusCode)
-	}
-
-	return nil
+	return e.Provider.Ping(context.Background())
 }
 
 // returns the dimension of embeddings for this model
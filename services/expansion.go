@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// query expansion strategies
+const (
+	ExpansionNone       = "none"
+	ExpansionHyDE       = "hyde"        // embed a hypothetical answer along with the question
+	ExpansionMultiQuery = "multi_query" // search with paraphrases of the question and fuse the results
+)
+
+// rank constant for reciprocal rank fusion, dampens the weight of the very top ranks
+const rrfK = 60
+
+// IsExpansion reports whether name is a known expansion strategy
+func IsExpansion(name string) bool {
+	switch name {
+	case "", ExpansionNone, ExpansionHyDE, ExpansionMultiQuery:
+		return true
+	}
+	return false
+}
+
+// RetrieveExpanded retrieves with an expansion strategy and returns the generated text it searched with
+// short questions embed poorly with the word-frequency embedder, a passage-like query matches chunks better
+// paraphrases is the number of rewrites for multi-query expansion
+func (r *Retriever) RetrieveExpanded(ctx context.Context, query string, topK int, bookID string, filter *models.ChunkFilter, expansion string, paraphrases int) ([]models.SearchResult, []string, error) {
+	if expansion == "" || expansion == ExpansionNone {
+		results, err := r.RetrieveFiltered(ctx, query, topK, bookID, filter)
+		return results, nil, err
+	}
+	if r.generator == nil {
+		return nil, nil, fmt.Errorf("query expansion %q needs a generator", expansion)
+	}
+
+	switch expansion {
+	case ExpansionHyDE:
+		return r.retrieveHyDE(ctx, query, topK, bookID, filter)
+	case ExpansionMultiQuery:
+		return r.retrieveMultiQuery(ctx, query, topK, bookID, filter, paraphrases)
+	}
+	return nil, nil, fmt.Errorf("unknown query expansion %q", expansion)
+}
+
+// search with the embedding of a passage the LLM imagines would answer the question
+func (r *Retriever) retrieveHyDE(ctx context.Context, query string, topK int, bookID string, filter *models.ChunkFilter) ([]models.SearchResult, []string, error) {
+	var sb strings.Builder
+	sb.WriteString("Write a short passage from a book that answers the question below. ")
+	sb.WriteString("Write it as the book's own prose, in three or four sentences, without mentioning the question.\n\n")
+	sb.WriteString(fmt.Sprintf("Question: %s\n\nPassage:", query))
+
+	passage, err := r.generator.CompletePrompt(ctx, sb.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate hypothetical answer: %w", err)
+	}
+	if passage == "" {
+		log.Printf("HyDE produced an empty passage, retrieving with the question")
+		results, err := r.RetrieveFiltered(ctx, query, topK, bookID, filter)
+		return results, nil, err
+	}
+
+	// the passage stands in for a chunk, so it is embedded like one
+	embedding, snapshot, _, err := r.embed(ctx, query+"\n"+passage, bookID, TaskDocument)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := r.search(ctx, embedding, snapshot, topK, bookID, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, []string{passage}, nil
+}
+
+// search with the question and its paraphrases, fusing the rankings with reciprocal rank fusion
+// each result keeps its best similarity as its score, fusion only decides which chunks make the top-K
+func (r *Retriever) retrieveMultiQuery(ctx context.Context, query string, topK int, bookID string, filter *models.ChunkFilter, paraphrases int) ([]models.SearchResult, []string, error) {
+	rewrites, err := r.paraphrase(ctx, query, paraphrases)
+	if err != nil {
+		log.Printf("Failed to paraphrase query, retrieving with the question only: %v", err)
+	}
+
+	type fused struct {
+		result models.SearchResult
+		score  float64
+	}
+	merged := make(map[string]*fused)
+	for _, q := range append([]string{query}, rewrites...) {
+		results, err := r.RetrieveFiltered(ctx, q, topK, bookID, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rank, result := range results {
+			id := result.Chunk.ID.Hex()
+			f, ok := merged[id]
+			if !ok {
+				f = &fused{result: result}
+				merged[id] = f
+			}
+			f.score += 1 / float64(rrfK+rank+1)
+			if result.Score > f.result.Score {
+				f.result.Score = result.Score
+			}
+		}
+	}
+
+	ranked := make([]*fused, 0, len(merged))
+	for _, f := range merged {
+		ranked = append(ranked, f)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].result.Score > ranked[j].result.Score
+	})
+
+	if len(ranked) > topK {
+		ranked = ranked[:topK]
+	}
+	results := make([]models.SearchResult, len(ranked))
+	for i, f := range ranked {
+		results[i] = f.result
+	}
+	return results, rewrites, nil
+}
+
+// ask the LLM for n differently worded versions of the question
+func (r *Retriever) paraphrase(ctx context.Context, query string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Rewrite the following question about a book in %d different ways. ", n))
+	sb.WriteString("Use different words and mention the names, places or events the question is likely about. ")
+	sb.WriteString("Write one question per line as a numbered list, and nothing else.\n\n")
+	sb.WriteString(fmt.Sprintf("Question: %s\n\nRewritten questions:", query))
+
+	response, err := r.generator.CompletePrompt(ctx, sb.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var rewrites []string
+	for _, line := range parseSubQuestions(response, n+1) {
+		if !strings.EqualFold(line, query) {
+			rewrites = append(rewrites, line)
+		}
+		if len(rewrites) == n {
+			break
+		}
+	}
+	if len(rewrites) == 0 {
+		return nil, fmt.Errorf("no paraphrases in response %q", response)
+	}
+	return rewrites, nil
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// Explain runs the same retrieval as RetrieveFiltered and reports how each chunk was scored
+// and where the time went, for tuning top-K and chunking without generating answers
+func (r *Retriever) Explain(ctx context.Context, query string, topK int, bookID string, filter *models.ChunkFilter) (*models.RetrieveResponse, error) {
+	startTime := time.Now()
+
+	queryEmbedding, snapshot, model, err := r.embed(ctx, query, bookID, TaskQuery)
+	if err != nil {
+		return nil, err
+	}
+	embedTime := time.Since(startTime)
+
+	results, stats, err := r.store.FilteredVectorSearchStats(ctx, queryEmbedding, topK, bookID, filter, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("vector search failed: %w", err)
+	}
+
+	response := &models.RetrieveResponse{
+		Question:       query,
+		BookID:         bookID,
+		TopK:           topK,
+		EmbeddingModel: model,
+		EmbeddingDim:   len(queryEmbedding),
+		QueryNorm:      vectorNorm(queryEmbedding),
+		ChunksScanned:  stats.Scanned,
+		ChunksSkipped:  stats.Skipped,
+		Results:        make([]models.RetrievedChunk, len(results)),
+		Timings: models.RetrievalTimings{
+			EmbedMs: embedTime.Milliseconds(),
+			FetchMs: stats.FetchTime.Milliseconds(),
+			ScoreMs: stats.ScoreTime.Milliseconds(),
+			TotalMs: time.Since(startTime).Milliseconds(),
+		},
+	}
+
+	// ranking is by vector similarity alone, there are no keyword or rerank stages yet
+	for i, result := range results {
+		response.Results[i] = models.RetrievedChunk{
+			Rank:       i + 1,
+			ChunkID:    result.Chunk.ID.Hex(),
+			BookID:     result.Chunk.BookID,
+			ChunkIndex: result.Chunk.ChunkIndex,
+			Text:       result.Chunk.Text,
+			Metadata:   result.Chunk.Metadata,
+			Score:      result.Score,
+			Breakdown:  models.ScoreBreakdown{Vector: result.Score},
+		}
+	}
+	return response, nil
+}
+
+func vectorNorm(v []float32) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	return math.Sqrt(sum)
+}
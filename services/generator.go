@@ -1,162 +1,147 @@
 package services
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"log"
 	"strings"
-	"time"
+
+	"github.com/blavejr/bowattAI/models"
 )
 
-// handle LLM text generation via Ollama
+// handle LLM text generation via a ChatProvider (Ollama, OpenAI-compatible)
 type Generator struct {
-	BaseURL string
-	Model   string
-	Client  *http.Client
+	Provider  ChatProvider
+	Model     string
+	Options   models.GenerationOptions // defaults, requests may override them
+	Templates *PromptTemplates
 }
 
 // create a new generator client
-func NewGenerator(baseURL, model string) *Generator {
+// templates may be nil, in which case the built-in prompt is used
+func NewGenerator(provider ChatProvider, model string, options models.GenerationOptions, templates *PromptTemplates) *Generator {
+	if templates == nil {
+		var err error
+		if templates, err = LoadPromptTemplates("", "default"); err != nil {
+			log.Fatalf("Failed to load built-in prompt template: %v", err)
+		}
+	}
+
 	return &Generator{
-		BaseURL: baseURL,
-		Model:   model,
-		Client: &http.Client{
-			Timeout: 120 * time.Second, // longer timeout for generation
-		},
+		Provider:  provider,
+		Model:     model,
+		Options:   options,
+		Templates: templates,
 	}
 }
 
-// request to Ollama generation API
-type OllamaGenerateRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
+// GenerateRequest is a question with its retrieved passages
+type GenerateRequest struct {
+	Question string
+	Contexts []PromptContext
+	History  []models.Message // earlier conversation turns, oldest first
+	Template string           // prompt template name, empty for the default
+	Model    string           // overrides the generator's model
+	Options  models.GenerationOptions
+	// passages come from several books, so templates should say which
+	CrossBook bool
 }
 
-// response from Ollama generation API
-type OllamaGenerateResponse struct {
-	Model     string `json:"model"`
-	CreatedAt string `json:"created_at"`
-	Response  string `json:"response"`
-	Done      bool   `json:"done"`
+// the model and options a request will actually be generated with
+func (g *Generator) Resolve(req GenerateRequest) (string, models.GenerationOptions) {
+	model := req.Model
+	if model == "" {
+		model = g.Model
+	}
+	return model, MergeOptions(g.Options, req.Options)
+}
+
+func (g *Generator) completionRequest(req GenerateRequest, prompt string) CompletionRequest {
+	model, options := g.Resolve(req)
+	return CompletionRequest{
+		Model:   model,
+		Prompt:  prompt,
+		Options: options,
+	}
 }
 
 // generate a response based on query and context
 func (g *Generator) GenerateResponse(query string, contexts []string) (string, error) {
-	// build prompt with contexts
-	prompt := g.buildPrompt(query, contexts)
-
-	// prepare request
-	reqBody := OllamaGenerateRequest{
-		Model:  g.Model,
-		Prompt: prompt,
-		Stream: false,
-	}
+	return g.Generate(context.Background(), GenerateRequest{
+		Question: query,
+		Contexts: contextsFromText(contexts),
+	})
+}
 
-	jsonData, err := json.Marshal(reqBody)
+// generate a response for a question, its passages and optionally the conversation so far
+func (g *Generator) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	prompt, err := g.buildPrompt(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return "", err
 	}
 
-	// make request to Ollama
-	url := fmt.Sprintf("%s/api/generate", g.BaseURL)
-	resp, err := g.Client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	response, err := g.Provider.Complete(ctx, g.completionRequest(req, prompt))
 	if err != nil {
-		return "", fmt.Errorf("failed to call Ollama API: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	// check response status
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Ollama API error (status %d): %s", resp.StatusCode, string(body))
+	if response == "" {
+		return "", fmt.Errorf("received empty response from LLM")
 	}
 
-	// parse response
-	var genResp OllamaGenerateResponse
-	if err := json.NewDecoder(resp.Body).Decode(&genResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
-	}
+	return strings.TrimSpace(response), nil
+}
 
-	if genResp.Response == "" {
-		return "", fmt.Errorf("received empty response from Ollama")
+// stream a response, calling onDelta for each token
+// returns the full answer once generation finishes
+func (g *Generator) GenerateStream(ctx context.Context, req GenerateRequest, onDelta func(string) error) (string, error) {
+	prompt, err := g.buildPrompt(req)
+	if err != nil {
+		return "", err
 	}
 
-	return strings.TrimSpace(genResp.Response), nil
-}
-
-// build the prompt for the LLM
-func (g *Generator) buildPrompt(query string, contexts []string) string {
-	var sb strings.Builder
-
-	// system instruction
-	sb.WriteString("You are a helpful assistant answering questions about a book.\n")
-	sb.WriteString("Use ONLY the following context passages to answer the question.\n")
-	sb.WriteString("If the answer cannot be found in the context, say \"I cannot find this information in the provided text.\"\n")
-	sb.WriteString("Be concise and accurate. Cite specific details from the context when possible.\n\n")
-
-	// add contexts
-	sb.WriteString("Context:\n")
-	sb.WriteString("---\n")
-	for i, context := range contexts {
-		sb.WriteString(fmt.Sprintf("[%d] %s\n\n", i+1, context))
+	var answer strings.Builder
+	err = g.Provider.CompleteStream(ctx, g.completionRequest(req, prompt), func(delta string) error {
+		answer.WriteString(delta)
+		return onDelta(delta)
+	})
+	if err != nil {
+		return "", err
 	}
-	sb.WriteString("---\n\n")
 
-	// add question
-	sb.WriteString(fmt.Sprintf("Question: %s\n\n", query))
-	sb.WriteString("Answer:")
+	return strings.TrimSpace(answer.String()), nil
+}
 
-	return sb.String()
+// build the prompt for the LLM from the selected template
+func (g *Generator) buildPrompt(req GenerateRequest) (string, error) {
+	return g.Templates.Render(req.Template, PromptData{
+		Question:  req.Question,
+		Contexts:  req.Contexts,
+		History:   req.History,
+		CrossBook: req.CrossBook,
+	})
 }
 
 // allow using a custom prompt
 func (g *Generator) GenerateWithCustomPrompt(prompt string) (string, error) {
-	reqBody := OllamaGenerateRequest{
-		Model:  g.Model,
-		Prompt: prompt,
-		Stream: false,
-	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
+	return g.CompletePrompt(context.Background(), prompt)
+}
 
-	url := fmt.Sprintf("%s/api/generate", g.BaseURL)
-	resp, err := g.Client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+// run a custom prompt with the default model and options
+func (g *Generator) CompletePrompt(ctx context.Context, prompt string) (string, error) {
+	response, err := g.Provider.Complete(ctx, CompletionRequest{
+		Model:   g.Model,
+		Prompt:  prompt,
+		Options: g.Options,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to call Ollama API: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Ollama API error (status %d): %s", resp.StatusCode, string(body))
-	}
-
-	var genResp OllamaGenerateResponse
-	if err := json.NewDecoder(resp.Body).Decode(&genResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return "", err
 	}
 
-	return strings.TrimSpace(genResp.Response), nil
+	return strings.TrimSpace(response), nil
 }
 
-// test the connection to Ollama
+// test the connection to the LLM backend
 func (g *Generator) TestConnection() error {
-	url := fmt.Sprintf("%s/api/tags", g.BaseURL)
-	resp, err := g.Client.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to connect to Ollama: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Ollama API returned status %d", resp.StatusCode)
-	}
-
-	return nil
+	return g.Provider.Ping(context.Background())
 }
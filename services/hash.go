@@ -0,0 +1,42 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// ContentHash identifies a text by its content, ignoring differences in whitespace and line endings
+// the text is normalised the same way as before chunking
+func ContentHash(text string) string {
+	sum := sha256.Sum256([]byte(cleanText(text)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ContentHashReader computes ContentHash of the text read from r without holding it in memory
+func ContentHashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	cleaner := newTextCleaner(r)
+	const blockSize = 64 * 1024
+	buf := make([]byte, 0, blockSize+utf8.UTFMax+1)
+	for {
+		var eof bool
+		var err error
+		buf, eof, err = cleaner.fill(buf[:0], blockSize)
+		if err != nil {
+			return "", fmt.Errorf("failed to read text: %w", err)
+		}
+		hash.Write(buf)
+		if eof {
+			return hex.EncodeToString(hash.Sum(nil)), nil
+		}
+	}
+}
+
+// ChunkHash identifies a chunk by its text, which is already normalised
+func ChunkHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/storage"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrEmptyText is returned when a book or a new version of it has no text to chunk
+var ErrEmptyText = errors.New("no text after cleaning")
+
+// Ingester stores uploaded books without holding them in memory
+// 1. Reading, cleaning and chunking the text as it streams in
+// 2. Embedding the chunks in batches of batchSize
+// 3. Inserting each batch while the book is pending, and publishing the book once every batch is stored
+// memory use depends on the batch size, not on the size of the book
+type Ingester struct {
+	store     *storage.MongoStore
+	chunker   *Chunker
+	embedder  *Embedder
+	batchSize int
+}
+
+func NewIngester(store *storage.MongoStore, chunker *Chunker, embedder *Embedder, batchSize int) *Ingester {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &Ingester{
+		store:     store,
+		chunker:   chunker,
+		embedder:  embedder,
+		batchSize: batchSize,
+	}
+}
+
+// IngestRequest describes a book to ingest, its text is read separately
+type IngestRequest struct {
+	Title          string
+	Author         string
+	Tags           []string
+	PromptTemplate string
+	ContentHash    string // of the whole text, computed beforehand to check for duplicates
+	OriginalBookID string
+}
+
+// IngestStats reports where the time went, summed over batches
+type IngestStats struct {
+	ChunkTime time.Duration
+	EmbedTime time.Duration
+	StoreTime time.Duration
+}
+
+// Ingest reads a book from r and stores it as a new book, all or nothing
+// returns ErrEmptyText if there is no text to chunk
+func (i *Ingester) Ingest(ctx context.Context, r io.Reader, req IngestRequest) (*models.Book, *IngestStats, error) {
+	book := &models.Book{
+		ID:             primitive.NewObjectID().Hex(),
+		Title:          req.Title,
+		Author:         req.Author,
+		ChunkSize:      i.chunker.ChunkSize,
+		ChunkOverlap:   i.chunker.ChunkOverlap,
+		EmbeddingModel: i.embedder.Model,
+		Tags:           req.Tags,
+		PromptTemplate: req.PromptTemplate,
+		ContentHash:    req.ContentHash,
+		OriginalBookID: req.OriginalBookID,
+		Version:        1,
+		UploadedAt:     time.Now(),
+	}
+	log.Printf("Book ID generated - %s", book.ID)
+
+	if err := i.store.BeginBook(ctx, book); err != nil {
+		return nil, nil, err
+	}
+
+	stats, err := i.ingest(ctx, r, book)
+	if err == nil && book.TotalChunks == 0 {
+		err = ErrEmptyText
+	}
+	if err == nil {
+		book.Versions = []models.BookVersion{{
+			Version:        1,
+			ContentHash:    book.ContentHash,
+			TotalChunks:    book.TotalChunks,
+			TotalChars:     book.TotalChars,
+			Chapters:       book.Chapters,
+			EmbeddedChunks: book.TotalChunks,
+			UploadedAt:     book.UploadedAt,
+		}}
+		err = i.store.PublishBook(ctx, book)
+	}
+	if err != nil {
+		if abortErr := i.store.AbortBook(ctx, book.ID); abortErr != nil {
+			log.Printf("ERROR: failed to remove unfinished upload of %s, it stays pending until the cleanup after PENDING_UPLOAD_TIMEOUT: %v", book.ID, abortErr)
+		}
+		return nil, nil, err
+	}
+	return book, stats, nil
+}
+
+// chunk, embed and insert the text batch by batch, recording the totals on book
+func (i *Ingester) ingest(ctx context.Context, r io.Reader, book *models.Book) (*IngestStats, error) {
+	stats := &IngestStats{}
+	var chapters ChapterDetector
+	batch := make([]ChunkSpan, 0, i.batchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		texts := make([]string, len(batch))
+		for j, span := range batch {
+			texts[j] = span.Text
+		}
+
+		embedStart := time.Now()
+		embeddings, err := i.embedder.GenerateEmbeddingsBatch(texts, 1)
+		if err != nil {
+			return fmt.Errorf("failed to generate embeddings: %w", err)
+		}
+		stats.EmbedTime += time.Since(embedStart)
+
+		docs := make([]models.Chunk, len(batch))
+		for j, span := range batch {
+			chapter := chapters.Next(span.Text)
+
+			docs[j] = models.Chunk{
+				ID:         primitive.NewObjectID(),
+				BookID:     book.ID,
+				ChunkIndex: book.TotalChunks + j,
+				Text:       span.Text,
+				Embedding:  embeddings[j],
+				// record the model so queries embed with the same one
+				EmbeddingModel: i.embedder.Model,
+				EmbeddingDim:   len(embeddings[j]),
+				ContentHash:    ChunkHash(span.Text),
+				Versions:       []int{1},
+				Metadata: models.ChunkMetadata{
+					BookTitle:      book.Title,
+					BookAuthor:     book.Author,
+					Chapter:        chapter,
+					CharacterStart: span.Start,
+					CharacterEnd:   span.End,
+					HasOffsets:     true,
+					ChunkSize:      len(span.Text),
+					PromptTemplate: book.PromptTemplate,
+					Tags:           book.Tags,
+				},
+				CreatedAt: time.Now(),
+			}
+		}
+
+		storeStart := time.Now()
+		if err := i.store.InsertChunks(ctx, docs); err != nil {
+			return err
+		}
+		// long uploads stay newer than the pending cleanup cutoff
+		if err := i.store.TouchBook(ctx, book.ID); err != nil {
+			return err
+		}
+		stats.StoreTime += time.Since(storeStart)
+
+		book.Chapters = chapters.Chapters()
+		book.EmbeddingDim = len(embeddings[0])
+		book.TotalChunks += len(batch)
+		book.TotalChars = batch[len(batch)-1].End
+		batch = batch[:0]
+		return nil
+	}
+
+	chunkStart := time.Now()
+	err := i.chunker.ChunkReader(r, func(span ChunkSpan) error {
+		batch = append(batch, span)
+		if len(batch) < i.batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// chunking time is what's left once embedding and storing are taken out
+	stats.ChunkTime = time.Since(chunkStart) - stats.EmbedTime - stats.StoreTime
+	return stats, nil
+}
@@ -0,0 +1,505 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blavejr/bowattAI/storage"
+
+	"github.com/goccy/go-yaml"
+)
+
+// formats read by the ingest command, by file extension
+// every format is ingested as plain text, markdown keeps its markup
+var bookFormats = map[string]string{
+	".txt":      "text",
+	".text":     "text",
+	".md":       "markdown",
+	".markdown": "markdown",
+}
+
+// extensions of sidecar manifests, tried in this order
+var manifestExtensions = []string{".json", ".yaml", ".yml"}
+
+// how much of a book is searched for a title and author
+const headerSearchBytes = 16 * 1024
+
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// ErrNoBook is set on a .json or .yaml file that isn't the manifest of a book next to it
+var ErrNoBook = errors.New("no book with the same name for this manifest")
+
+// BookFile is a book found on disk by ScanBooks
+type BookFile struct {
+	Path           string
+	Format         string // text or markdown, empty if the file can't be ingested
+	Title          string
+	Author         string
+	Tags           []string
+	PromptTemplate string
+	Source         string // where the title came from: manifest, header, front matter or filename
+	BodyOffset     int64  // length of the markdown front matter, which isn't ingested
+	Err            error  // why the file can't be ingested, if it can't
+}
+
+// BookManifest describes a book in a sidecar file next to it
+// the sidecar has the book's name with a .json, .yaml or .yml extension, e.g. pride.yaml for pride.txt
+type BookManifest struct {
+	Title          string   `json:"title" yaml:"title"`
+	Author         string   `json:"author" yaml:"author"`
+	Tags           []string `json:"tags" yaml:"tags"`
+	PromptTemplate string   `json:"prompt_template" yaml:"prompt_template"`
+}
+
+// ScanBooks finds the books under root, which may also be a single file
+// hidden files and directories and sidecar manifests are skipped
+// files in other formats, and manifests without a book, are returned with Err set
+func ScanBooks(root string) ([]BookFile, error) {
+	var books []BookFile
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if isManifest(path) {
+			if !hasBook(path) {
+				books = append(books, BookFile{Path: path, Err: ErrNoBook})
+			}
+			return nil
+		}
+		books = append(books, readBookFile(path))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", root, err)
+	}
+	return books, nil
+}
+
+func isManifest(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, manifestExt := range manifestExtensions {
+		if ext == manifestExt {
+			return true
+		}
+	}
+	return false
+}
+
+// whether a manifest sits next to a file with the same name that isn't a manifest itself
+func hasBook(manifest string) bool {
+	dir := filepath.Dir(manifest)
+	stem := strings.TrimSuffix(filepath.Base(manifest), filepath.Ext(manifest))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || isManifest(name) {
+			continue
+		}
+		if strings.TrimSuffix(name, filepath.Ext(name)) == stem {
+			return true
+		}
+	}
+	return false
+}
+
+// work out the format, title and author of a book
+// a sidecar manifest wins, then the book's own header or front matter, then the file name
+func readBookFile(path string) BookFile {
+	book := BookFile{Path: path}
+
+	head, err := readHead(path)
+	if err != nil {
+		book.Err = err
+		return book
+	}
+	book.Format, err = detectFormat(path, head)
+	if err != nil {
+		book.Err = err
+		return book
+	}
+
+	var meta BookManifest
+	switch book.Format {
+	case "markdown":
+		meta, book.BodyOffset, err = frontMatter(head)
+		book.Source = "front matter"
+	default:
+		meta = gutenbergHeader(head)
+		book.Source = "header"
+	}
+	if err != nil {
+		book.Err = err
+		return book
+	}
+	book.Title, book.Author, book.Tags, book.PromptTemplate = meta.Title, meta.Author, meta.Tags, meta.PromptTemplate
+	if book.Title == "" {
+		book.Source = "filename"
+	}
+
+	manifest, found, err := readManifest(path)
+	if err != nil {
+		book.Err = err
+		return book
+	}
+	if found {
+		if manifest.Title != "" {
+			book.Title = manifest.Title
+			book.Source = "manifest"
+		}
+		if manifest.Author != "" {
+			book.Author = manifest.Author
+		}
+		if manifest.Tags != nil {
+			book.Tags = manifest.Tags
+		}
+		if manifest.PromptTemplate != "" {
+			book.PromptTemplate = manifest.PromptTemplate
+		}
+	}
+
+	if book.Title == "" {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		book.Title = strings.NewReplacer("_", " ", "-", " ").Replace(name)
+	}
+	if book.Author == "" {
+		book.Author = "Unknown"
+	}
+	book.Tags = NormalizeTags(book.Tags)
+	return book
+}
+
+func readHead(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	head, err := io.ReadAll(io.LimitReader(f, headerSearchBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return head, nil
+}
+
+// known extensions decide the format, anything else is sniffed and accepted if it looks like plain text
+func detectFormat(path string, head []byte) (string, error) {
+	if format, ok := bookFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		return format, nil
+	}
+	contentType := http.DetectContentType(head)
+	if strings.HasPrefix(contentType, "text/plain") {
+		return "text", nil
+	}
+	return "", fmt.Errorf("%w %s", ErrUnsupportedFormat, strings.Split(contentType, ";")[0])
+}
+
+// Project Gutenberg texts start with "Title: ..." and "Author: ..." lines
+func gutenbergHeader(head []byte) BookManifest {
+	var meta BookManifest
+	scanner := bufio.NewScanner(bytes.NewReader(head))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if title, ok := strings.CutPrefix(line, "Title:"); ok && meta.Title == "" {
+			meta.Title = strings.TrimSpace(title)
+		}
+		if author, ok := strings.CutPrefix(line, "Author:"); ok && meta.Author == "" {
+			meta.Author = strings.TrimSpace(author)
+		}
+		if meta.Title != "" && meta.Author != "" {
+			break
+		}
+	}
+	return meta
+}
+
+// markdown may start with a YAML block between "---" lines, with LF or CRLF line endings
+// returns its fields and its length in bytes, delimiters included, 0 if there is none
+func frontMatter(head []byte) (BookManifest, int64, error) {
+	var meta BookManifest
+	pos := 0
+	if bytes.HasPrefix(head, []byte("\ufeff")) {
+		pos = len("\ufeff")
+	}
+
+	line, next := nextLine(head, pos)
+	if line != "---" {
+		return meta, 0, nil
+	}
+	blockStart := next
+	for next < len(head) {
+		lineStart := next
+		line, next = nextLine(head, next)
+		if line == "---" || line == "..." {
+			if err := yaml.Unmarshal(head[blockStart:lineStart], &meta); err != nil {
+				return meta, 0, fmt.Errorf("failed to parse front matter: %w", err)
+			}
+			return meta, int64(next), nil
+		}
+	}
+	// not closed within the head, read as text
+	return BookManifest{}, 0, nil
+}
+
+// FrontMatterLength is the length in bytes of the front matter an uploaded markdown file starts with, 0 for other files
+// uploads leave it out like bulk ingestion does, so the same file has the same text and hash either way
+func FrontMatterLength(name string, r io.Reader) (int64, error) {
+	if bookFormats[strings.ToLower(filepath.Ext(name))] != "markdown" {
+		return 0, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(r, headerSearchBytes))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+	_, offset, err := frontMatter(head)
+	return offset, err
+}
+
+// the line starting at pos without its line ending, and where the next line starts
+func nextLine(data []byte, pos int) (string, int) {
+	end := bytes.IndexByte(data[pos:], '\n')
+	if end < 0 {
+		return strings.TrimSuffix(string(data[pos:]), "\r"), len(data)
+	}
+	return strings.TrimSuffix(string(data[pos:pos+end]), "\r"), pos + end + 1
+}
+
+// read the sidecar manifest of a book, found is false if it has none
+func readManifest(path string) (manifest BookManifest, found bool, err error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, ext := range manifestExtensions {
+		data, err := os.ReadFile(base + ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return manifest, false, fmt.Errorf("failed to read manifest: %w", err)
+		}
+
+		if ext == ".json" {
+			err = json.Unmarshal(data, &manifest)
+		} else {
+			err = yaml.Unmarshal(data, &manifest)
+		}
+		if err != nil {
+			return manifest, false, fmt.Errorf("failed to parse manifest %s: %w", filepath.Base(base+ext), err)
+		}
+		return manifest, true, nil
+	}
+	return manifest, false, nil
+}
+
+// outcomes of ingesting a file
+const (
+	IngestIngested = "ingested"
+	IngestSkipped  = "skipped"
+	IngestFailed   = "failed"
+)
+
+// IngestResult is the outcome of ingesting one file
+type IngestResult struct {
+	File     BookFile
+	Status   string
+	Reason   string // why the file was skipped or failed
+	BookID   string // of the new book, or of the book a skipped file duplicates
+	Chunks   int
+	Duration time.Duration
+}
+
+// IngestFiles ingests books through the same pipeline as uploads, workers at a time
+// files whose text was already ingested, or appears earlier in files, are skipped unless force is set,
+// with force they are ingested as copies of the first book with that text
+// results are in the order of files
+func (i *Ingester) IngestFiles(ctx context.Context, files []BookFile, workers int, force bool) []IngestResult {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	results := make([]IngestResult, len(files))
+	jobs := make(chan int)
+
+	// first file seen with each content hash in this run
+	var mu sync.Mutex
+	claimed := make(map[string]*hashClaim)
+	claim := func(hash, path string) (*hashClaim, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if first, ok := claimed[hash]; ok {
+			return first, false
+		}
+		first := &hashClaim{path: path, done: make(chan struct{})}
+		claimed[hash] = first
+		return first, true
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx] = i.ingestFile(ctx, files[idx], force, claim)
+			}
+		}()
+	}
+	for idx := range files {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// the first file of an IngestFiles run with some text, later copies wait for it to finish
+type hashClaim struct {
+	path   string
+	done   chan struct{}
+	bookID string // the book later copies link to, set before done is closed, empty if the file wasn't stored
+}
+
+func (i *Ingester) ingestFile(ctx context.Context, file BookFile, force bool, claim func(hash, path string) (*hashClaim, bool)) IngestResult {
+	startTime := time.Now()
+	result := IngestResult{File: file}
+	done := func(status, reason string) IngestResult {
+		result.Status = status
+		result.Reason = reason
+		result.Duration = time.Since(startTime)
+		return result
+	}
+
+	if file.Err != nil {
+		if errors.Is(file.Err, ErrUnsupportedFormat) || errors.Is(file.Err, ErrNoBook) {
+			return done(IngestSkipped, file.Err.Error())
+		}
+		return done(IngestFailed, file.Err.Error())
+	}
+
+	contentHash, err := hashFile(file.Path, file.BodyOffset)
+	if err != nil {
+		return done(IngestFailed, err.Error())
+	}
+
+	// a copy of a file earlier in this run waits for it, the first copy's book is still pending
+	// and can't be found by its hash, and a second original would hit the unique hash index
+	originalBookID := ""
+	first, owner := claim(contentHash, file.Path)
+	if owner {
+		defer close(first.done)
+	} else {
+		<-first.done
+		if !force {
+			result.BookID = first.bookID
+			return done(IngestSkipped, fmt.Sprintf("same text as %s", first.path))
+		}
+		originalBookID = first.bookID
+	}
+
+	if originalBookID == "" {
+		existing, err := i.store.FindBookByContentHash(ctx, contentHash)
+		if err != nil {
+			return done(IngestFailed, err.Error())
+		}
+		if existing != nil {
+			originalBookID = existing.ID
+			if existing.OriginalBookID != "" {
+				originalBookID = existing.OriginalBookID
+			}
+			if !force {
+				result.BookID = existing.ID
+				if owner {
+					first.bookID = originalBookID
+				}
+				return done(IngestSkipped, "already ingested")
+			}
+		}
+	}
+
+	src, err := openBody(file.Path, file.BodyOffset)
+	if err != nil {
+		return done(IngestFailed, err.Error())
+	}
+	defer src.Close()
+
+	log.Printf("Ingesting %s: %s by %s", file.Path, file.Title, file.Author)
+	book, _, err := i.Ingest(ctx, src, IngestRequest{
+		Title:          file.Title,
+		Author:         file.Author,
+		Tags:           file.Tags,
+		PromptTemplate: file.PromptTemplate,
+		ContentHash:    contentHash,
+		OriginalBookID: originalBookID,
+	})
+	if errors.Is(err, ErrEmptyText) {
+		return done(IngestSkipped, "file is empty")
+	}
+	if errors.Is(err, storage.ErrDuplicateBook) {
+		return done(IngestSkipped, "already ingested")
+	}
+	if err != nil {
+		return done(IngestFailed, err.Error())
+	}
+
+	result.BookID = book.ID
+	result.Chunks = book.TotalChunks
+	if owner {
+		first.bookID = book.ID
+		if originalBookID != "" {
+			first.bookID = originalBookID
+		}
+	}
+	return done(IngestIngested, "")
+}
+
+// open a book at the start of its text, after offset bytes of front matter
+func openBody(path string, offset int64) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return f, nil
+}
+
+// hash the text of a book like uploads are, leaving out its front matter
+func hashFile(path string, offset int64) (string, error) {
+	f, err := openBody(path, offset)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash, err := ContentHashReader(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return hash, nil
+}
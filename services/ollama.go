@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// OllamaProvider talks to the Ollama REST API
+type OllamaProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewOllamaProvider(baseURL string, timeout time.Duration) *OllamaProvider {
+	return &OllamaProvider{
+		BaseURL: baseURL,
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+type OllamaEmbedRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type OllamaEmbedResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+// request to Ollama generation API
+type OllamaGenerateRequest struct {
+	Model   string                    `json:"model"`
+	Prompt  string                    `json:"prompt"`
+	Stream  bool                      `json:"stream"`
+	Options *models.GenerationOptions `json:"options,omitempty"`
+}
+
+// response from Ollama generation API
+type OllamaGenerateResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Response  string `json:"response"`
+	Done      bool   `json:"done"`
+}
+
+func (p *OllamaProvider) Embed(ctx context.Context, model, text string) ([]float32, error) {
+	var embedResp OllamaEmbedResponse
+	if err := p.post(ctx, "/api/embeddings", OllamaEmbedRequest{Model: model, Prompt: text}, &embedResp); err != nil {
+		return nil, err
+	}
+
+	if len(embedResp.Embedding) == 0 {
+		return nil, fmt.Errorf("received empty embedding from ollama")
+	}
+
+	return embedResp.Embedding, nil
+}
+
+func (p *OllamaProvider) Complete(ctx context.Context, req CompletionRequest) (string, error) {
+	reqBody := OllamaGenerateRequest{
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Stream:  false,
+		Options: &req.Options,
+	}
+
+	var genResp OllamaGenerateResponse
+	if err := p.post(ctx, "/api/generate", reqBody, &genResp); err != nil {
+		return "", err
+	}
+
+	return genResp.Response, nil
+}
+
+// stream a completion from Ollama's NDJSON response
+func (p *OllamaProvider) CompleteStream(ctx context.Context, req CompletionRequest, onDelta func(string) error) error {
+	reqBody := OllamaGenerateRequest{
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Stream:  true,
+		Options: &req.Options,
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+"/api/generate", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	// no client timeout, the stream lives as long as ctx
+	client := &http.Client{Transport: p.Client.Transport}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to call Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Ollama API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var chunk struct {
+			OllamaGenerateResponse
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return fmt.Errorf("failed to decode stream chunk: %w", err)
+		}
+		if chunk.Error != "" {
+			return fmt.Errorf("Ollama stream error: %s", chunk.Error)
+		}
+
+		if chunk.Response != "" {
+			if err := onDelta(chunk.Response); err != nil {
+				return err
+			}
+		}
+		if chunk.Done {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	return nil
+}
+
+func (p *OllamaProvider) Ping(ctx context.Context) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.BaseURL+"/api/tags", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := p.Client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Ollama API returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// send a JSON request to Ollama and decode the JSON response
+func (p *OllamaProvider) post(ctx context.Context, path string, reqBody, respBody interface{}) error {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.Client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to call Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Ollama API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
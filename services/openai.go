@@ -0,0 +1,228 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAIProvider talks to any server implementing the OpenAI REST API (llama.cpp, vLLM, ...)
+type OpenAIProvider struct {
+	BaseURL string // without the /v1 suffix
+	APIKey  string // optional, sent as a bearer token
+	Client  *http.Client
+}
+
+func NewOpenAIProvider(baseURL, apiKey string, timeout time.Duration) *OpenAIProvider {
+	return &OpenAIProvider{
+		BaseURL: strings.TrimSuffix(strings.TrimSuffix(baseURL, "/"), "/v1"),
+		APIKey:  apiKey,
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+type OpenAIEmbeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type OpenAIEmbeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+}
+
+type OpenAIChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type OpenAIChatRequest struct {
+	Model       string              `json:"model"`
+	Messages    []OpenAIChatMessage `json:"messages"`
+	Stream      bool                `json:"stream"`
+	Temperature *float64            `json:"temperature,omitempty"`
+	TopP        *float64            `json:"top_p,omitempty"`
+	MaxTokens   *int                `json:"max_tokens,omitempty"`
+	Seed        *int                `json:"seed,omitempty"`
+	Stop        []string            `json:"stop,omitempty"`
+}
+
+// build a chat request for a single prompt
+// num_ctx has no OpenAI equivalent, the server's context size applies
+func newOpenAIChatRequest(req CompletionRequest, stream bool) OpenAIChatRequest {
+	chatReq := OpenAIChatRequest{
+		Model: req.Model,
+		Messages: []OpenAIChatMessage{
+			{Role: "user", Content: req.Prompt},
+		},
+		Stream:      stream,
+		Temperature: req.Options.Temperature,
+		TopP:        req.Options.TopP,
+		Seed:        req.Options.Seed,
+		Stop:        req.Options.Stop,
+	}
+	if req.Options.NumPredict != nil && *req.Options.NumPredict > 0 {
+		chatReq.MaxTokens = req.Options.NumPredict
+	}
+	return chatReq
+}
+
+type OpenAIChatResponse struct {
+	Choices []struct {
+		Message      OpenAIChatMessage `json:"message"`
+		FinishReason string            `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+func (p *OpenAIProvider) Embed(ctx context.Context, model, text string) ([]float32, error) {
+	var embedResp OpenAIEmbeddingResponse
+	if err := p.do(ctx, http.MethodPost, "/v1/embeddings", OpenAIEmbeddingRequest{Model: model, Input: text}, &embedResp); err != nil {
+		return nil, err
+	}
+
+	if len(embedResp.Data) == 0 || len(embedResp.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("received empty embedding from OpenAI-compatible API")
+	}
+
+	return embedResp.Data[0].Embedding, nil
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, req CompletionRequest) (string, error) {
+	reqBody := newOpenAIChatRequest(req, false)
+
+	var chatResp OpenAIChatResponse
+	if err := p.do(ctx, http.MethodPost, "/v1/chat/completions", reqBody, &chatResp); err != nil {
+		return "", err
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return "", fmt.Errorf("received no choices from OpenAI-compatible API")
+	}
+
+	return chatResp.Choices[0].Message.Content, nil
+}
+
+// stream a completion from the server-sent events of /v1/chat/completions
+func (p *OpenAIProvider) CompleteStream(ctx context.Context, req CompletionRequest, onDelta func(string) error) error {
+	reqBody := newOpenAIChatRequest(req, true)
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+"/v1/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	if p.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	// no client timeout, the stream lives as long as ctx
+	client := &http.Client{Transport: p.Client.Transport}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to call OpenAI-compatible API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("OpenAI-compatible API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta OpenAIChatMessage `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("failed to decode stream chunk: %w", err)
+		}
+
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			if err := onDelta(chunk.Choices[0].Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	return nil
+}
+
+func (p *OpenAIProvider) Ping(ctx context.Context) error {
+	var models struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	return p.do(ctx, http.MethodGet, "/v1/models", nil, &models)
+}
+
+// send a JSON request and decode the JSON response
+func (p *OpenAIProvider) do(ctx context.Context, method, path string, reqBody, respBody interface{}) error {
+	var body io.Reader
+	if reqBody != nil {
+		jsonData, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewBuffer(jsonData)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, p.BaseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if reqBody != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if p.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	resp, err := p.Client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to call OpenAI-compatible API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("OpenAI-compatible API error (status %d): %s", resp.StatusCode, string(errBody))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
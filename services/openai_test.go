@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// stub OpenAI-compatible server recording the last request it received
+type openAIStub struct {
+	t          *testing.T
+	status     int
+	authHeader string
+	path       string
+	body       map[string]interface{}
+}
+
+func newOpenAIStub(t *testing.T, status int) (*openAIStub, *OpenAIProvider) {
+	stub := &openAIStub{t: t, status: status}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	// the /v1 suffix is optional in the configured base URL
+	return stub, NewOpenAIProvider(server.URL+"/v1/", "test-key", 5*time.Second)
+}
+
+func (s *openAIStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.authHeader = r.Header.Get("Authorization")
+	s.path = r.URL.Path
+	s.body = nil
+	if r.Body != nil && r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&s.body); err != nil {
+			s.t.Errorf("stub: failed to decode request body: %v", err)
+		}
+	}
+
+	if s.status != http.StatusOK {
+		w.WriteHeader(s.status)
+		fmt.Fprint(w, `{"error":{"message":"model not loaded"}}`)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/v1/embeddings":
+		fmt.Fprint(w, `{"data":[{"embedding":[0.5,-0.25,1],"index":0}]}`)
+	case "/v1/chat/completions":
+		if stream, _ := s.body["stream"].(bool); stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" world\"}}]}\n\n")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hello world"},"finish_reason":"stop"}]}`)
+	case "/v1/models":
+		fmt.Fprint(w, `{"data":[{"id":"test-model"}]}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestOpenAIEmbed(t *testing.T) {
+	stub, provider := newOpenAIStub(t, http.StatusOK)
+
+	embedding, err := provider.Embed(context.Background(), "nomic-embed-text", "some text")
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if want := []float32{0.5, -0.25, 1}; fmt.Sprint(embedding) != fmt.Sprint(want) {
+		t.Errorf("embedding = %v, want %v", embedding, want)
+	}
+	if stub.path != "/v1/embeddings" {
+		t.Errorf("path = %q, want /v1/embeddings", stub.path)
+	}
+	if stub.authHeader != "Bearer test-key" {
+		t.Errorf("Authorization = %q, want %q", stub.authHeader, "Bearer test-key")
+	}
+	if stub.body["model"] != "nomic-embed-text" || stub.body["input"] != "some text" {
+		t.Errorf("request body = %v", stub.body)
+	}
+}
+
+func TestOpenAIComplete(t *testing.T) {
+	stub, provider := newOpenAIStub(t, http.StatusOK)
+
+	temperature, numPredict := 0.2, 64
+	answer, err := provider.Complete(context.Background(), CompletionRequest{
+		Model:   "llama3.2:3b",
+		Prompt:  "Say hello",
+		Options: models.GenerationOptions{Temperature: &temperature, NumPredict: &numPredict},
+	})
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if answer != "Hello world" {
+		t.Errorf("answer = %q, want %q", answer, "Hello world")
+	}
+	if stub.path != "/v1/chat/completions" {
+		t.Errorf("path = %q, want /v1/chat/completions", stub.path)
+	}
+	if stub.authHeader != "Bearer test-key" {
+		t.Errorf("Authorization = %q, want %q", stub.authHeader, "Bearer test-key")
+	}
+	if stub.body["temperature"] != 0.2 || stub.body["max_tokens"] != float64(64) || stub.body["stream"] != false {
+		t.Errorf("request body = %v", stub.body)
+	}
+}
+
+func TestOpenAICompleteStream(t *testing.T) {
+	_, provider := newOpenAIStub(t, http.StatusOK)
+
+	var deltas []string
+	err := provider.CompleteStream(context.Background(), CompletionRequest{Model: "llama3.2:3b", Prompt: "Say hello"}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("CompleteStream: %v", err)
+	}
+	if got := strings.Join(deltas, "|"); got != "Hello| world" {
+		t.Errorf("deltas = %q, want %q", got, "Hello| world")
+	}
+}
+
+func TestOpenAIErrorStatus(t *testing.T) {
+	_, provider := newOpenAIStub(t, http.StatusServiceUnavailable)
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"embed": func() error {
+			_, err := provider.Embed(ctx, "nomic-embed-text", "some text")
+			return err
+		},
+		"complete": func() error {
+			_, err := provider.Complete(ctx, CompletionRequest{Model: "llama3.2:3b", Prompt: "Say hello"})
+			return err
+		},
+		"stream": func() error {
+			return provider.CompleteStream(ctx, CompletionRequest{Model: "llama3.2:3b", Prompt: "Say hello"}, func(string) error { return nil })
+		},
+	}
+	for name, call := range calls {
+		err := call()
+		if err == nil {
+			t.Errorf("%s: expected an error for status 503", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "status 503") || !strings.Contains(err.Error(), "model not loaded") {
+			t.Errorf("%s: error %q should include the status and response body", name, err)
+		}
+	}
+}
+
+func TestOpenAIWithoutAPIKey(t *testing.T) {
+	stub, provider := newOpenAIStub(t, http.StatusOK)
+	provider.APIKey = ""
+
+	if err := provider.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if stub.authHeader != "" {
+		t.Errorf("Authorization = %q, want no header without an API key", stub.authHeader)
+	}
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// MergeOptions applies the options set in override on top of defaults
+func MergeOptions(defaults, override models.GenerationOptions) models.GenerationOptions {
+	merged := defaults
+	if override.Temperature != nil {
+		merged.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		merged.TopP = override.TopP
+	}
+	if override.NumCtx != nil {
+		merged.NumCtx = override.NumCtx
+	}
+	if override.NumPredict != nil {
+		merged.NumPredict = override.NumPredict
+	}
+	if override.Seed != nil {
+		merged.Seed = override.Seed
+	}
+	if override.Stop != nil {
+		merged.Stop = override.Stop
+	}
+	return merged
+}
+
+// ValidateOptions rejects values the backends would refuse or silently clamp
+func ValidateOptions(opts models.GenerationOptions) error {
+	if opts.Temperature != nil && (*opts.Temperature < 0 || *opts.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if opts.TopP != nil && (*opts.TopP <= 0 || *opts.TopP > 1) {
+		return fmt.Errorf("top_p must be greater than 0 and at most 1")
+	}
+	if opts.NumCtx != nil && *opts.NumCtx <= 0 {
+		return fmt.Errorf("num_ctx must be positive")
+	}
+	// -1 lets Ollama generate until the context is full
+	if opts.NumPredict != nil && (*opts.NumPredict == 0 || *opts.NumPredict < -1) {
+		return fmt.Errorf("num_predict must be positive or -1")
+	}
+	if len(opts.Stop) > 4 {
+		return fmt.Errorf("at most 4 stop sequences are supported")
+	}
+	return nil
+}
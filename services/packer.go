@@ -0,0 +1,96 @@
+package services
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// don't bother truncating a passage into fewer tokens than this
+const minPartialTokens = 32
+
+// PackContexts fills a token budget with the highest scoring results
+// the first passage that doesn't fit is cut at a sentence boundary, everything after it is dropped
+// the best passage is always kept, truncated if necessary, so the generator has some context
+// a budget <= 0 means no limit
+func PackContexts(results []models.SearchResult, budget int) (packed, dropped []models.SearchResult) {
+	ordered := make([]models.SearchResult, len(results))
+	copy(ordered, results)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Score > ordered[j].Score
+	})
+	return PackContextsInOrder(ordered, budget)
+}
+
+// PackContextsInOrder fills a token budget like PackContexts but keeps the order of results
+// for callers that have already ranked them some other way
+func PackContextsInOrder(results []models.SearchResult, budget int) (packed, dropped []models.SearchResult) {
+	if budget <= 0 {
+		return results, nil
+	}
+
+	packed = []models.SearchResult{}
+	dropped = []models.SearchResult{}
+	used := 0
+	full := false
+
+	for _, result := range results {
+		if full {
+			dropped = append(dropped, result)
+			continue
+		}
+
+		tokens := EstimateTokens(result.Chunk.Text)
+		if used+tokens <= budget {
+			packed = append(packed, result)
+			used += tokens
+			continue
+		}
+
+		// budget runs out inside this passage
+		full = true
+		remaining := budget - used
+		if remaining < minPartialTokens && len(packed) > 0 {
+			dropped = append(dropped, result)
+			continue
+		}
+
+		text := truncateToTokens(result.Chunk.Text, remaining)
+		if text == "" {
+			dropped = append(dropped, result)
+			continue
+		}
+		result.Chunk.Text = text
+		result.Truncated = true
+		packed = append(packed, result)
+	}
+
+	return packed, dropped
+}
+
+// keep whole sentences while they fit, falling back to whole words
+func truncateToTokens(text string, budget int) string {
+	var sb strings.Builder
+	for _, sentence := range splitSentences(text) {
+		candidate := sentence
+		if sb.Len() > 0 {
+			candidate = sb.String() + " " + sentence
+		}
+		if EstimateTokens(candidate) > budget {
+			break
+		}
+		sb.Reset()
+		sb.WriteString(candidate)
+	}
+	if sb.Len() > 0 {
+		return sb.String()
+	}
+
+	// the first sentence alone is too long
+	words := strings.Fields(text)
+	for len(words) > 0 && EstimateTokens(strings.Join(words, " ")) > budget {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
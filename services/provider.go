@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/blavejr/bowattAI/config"
+	"github.com/blavejr/bowattAI/models"
+)
+
+// EmbeddingProvider turns text into a vector using a model served by some backend
+type EmbeddingProvider interface {
+	Embed(ctx context.Context, model, text string) ([]float32, error)
+	Ping(ctx context.Context) error
+}
+
+// ChatProvider generates text from a prompt using a model served by some backend
+type ChatProvider interface {
+	Complete(ctx context.Context, req CompletionRequest) (string, error)
+	// CompleteStream calls onDelta for each generated fragment and stops when ctx is cancelled
+	CompleteStream(ctx context.Context, req CompletionRequest, onDelta func(string) error) error
+	Ping(ctx context.Context) error
+}
+
+// a single prompt sent to a ChatProvider
+type CompletionRequest struct {
+	Model   string
+	Prompt  string
+	Options models.GenerationOptions
+}
+
+// pick the embedding backend from config
+func NewEmbeddingProvider(cfg *config.Config) EmbeddingProvider {
+	switch cfg.EmbeddingProvider {
+	case "openai":
+		return NewOpenAIProvider(cfg.OpenAIBaseURL, cfg.OpenAIAPIKey, 60*time.Second)
+	case "ollama", "":
+	default:
+		log.Printf("Warning: unknown EMBEDDING_PROVIDER %q, using ollama", cfg.EmbeddingProvider)
+	}
+	return NewOllamaProvider(cfg.OllamaURL, 60*time.Second)
+}
+
+// pick the generation backend from config
+func NewChatProvider(cfg *config.Config) ChatProvider {
+	switch cfg.LLMProvider {
+	case "openai":
+		return NewOpenAIProvider(cfg.OpenAIBaseURL, cfg.OpenAIAPIKey, 120*time.Second)
+	case "ollama", "":
+	default:
+		log.Printf("Warning: unknown LLM_PROVIDER %q, using ollama", cfg.LLMProvider)
+	}
+	return NewOllamaProvider(cfg.OllamaURL, 120*time.Second) // longer timeout for generation
+}
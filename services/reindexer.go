@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/storage"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// number of chunks re-embedded before writing them to the shadow field
+const reindexBatchSize = 32
+
+// how long finished jobs can be polled, and how many are kept
+const (
+	reindexJobTTL          = 24 * time.Hour
+	maxFinishedReindexJobs = 100
+)
+
+// ErrReindexRunning is returned when a reindex job already covers the book
+var ErrReindexRunning = errors.New("a reindex of this book is already running")
+
+// Reindexer re-embeds stored chunks with a different embedding model
+// 1. Streaming the chunks of each book from MongoDB
+// 2. Writing the new vectors to a shadow field, so queries keep using the old ones
+// 3. Swapping the shadow field in once every chunk of the book has been re-embedded
+// each book is claimed while it is reindexed, so no new version of it is stored meanwhile
+type Reindexer struct {
+	store    *storage.MongoStore
+	embedder *Embedder
+
+	mu   sync.Mutex
+	jobs map[string]*models.ReindexStatus
+}
+
+func NewReindexer(store *storage.MongoStore, embedder *Embedder) *Reindexer {
+	return &Reindexer{
+		store:    store,
+		embedder: embedder,
+		jobs:     make(map[string]*models.ReindexStatus),
+	}
+}
+
+// Reindex re-embeds one book, or every book if bookID is empty, and reports progress
+// books that are busy when every book is reindexed are skipped and listed in the status
+func (r *Reindexer) Reindex(ctx context.Context, bookID, model string, progress func(models.ReindexStatus)) error {
+	if model == "" {
+		model = r.embedder.Model
+	}
+
+	bookIDs := []string{bookID}
+	if bookID == "" {
+		ids, err := r.store.GetUniqueBookIDs(ctx)
+		if err != nil {
+			return err
+		}
+		bookIDs = ids
+	}
+
+	status := models.ReindexStatus{
+		BookID:    bookID,
+		Model:     model,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	for _, id := range bookIDs {
+		total, err := r.store.CountBookChunks(ctx, id)
+		if err != nil {
+			return err
+		}
+		status.TotalChunks += int(total)
+	}
+
+	claim := primitive.NewObjectID().Hex()
+	for i, id := range bookIDs {
+		book, err := r.store.ClaimReindex(ctx, id, claim)
+		// a library-wide reindex carries on past books taking a new version, they can be reindexed on their own later
+		if bookID == "" && errors.Is(err, storage.ErrBookBusy) {
+			log.Printf("Skipping book %s, a version upload or another reindex holds it", id)
+			status.SkippedBooks = append(status.SkippedBooks, id)
+			if progress != nil {
+				progress(status)
+			}
+			continue
+		}
+		if err != nil {
+			if book != nil {
+				r.release(id, claim)
+			}
+			return fmt.Errorf("failed to reindex book %s: %w", id, err)
+		}
+		if book == nil {
+			log.Printf("Skipping book %s, it has no book record or hasn't finished uploading", id)
+			continue
+		}
+
+		log.Printf("Reindexing book %s with %s (%d/%d)", id, model, i+1, len(bookIDs))
+		err = r.reindexBook(ctx, id, claim, model, &status, progress)
+		r.release(id, claim)
+		if err != nil {
+			return fmt.Errorf("failed to reindex book %s: %w", id, err)
+		}
+		status.BooksDone++
+		if progress != nil {
+			progress(status)
+		}
+	}
+
+	return nil
+}
+
+// finish or drop the swap of a book and let new versions in again
+func (r *Reindexer) release(bookID, claim string) {
+	if err := r.store.ReleaseReindex(context.Background(), bookID, claim); err != nil {
+		log.Printf("Warning: failed to release book %s after reindex, it is released by the cleanup after PENDING_UPLOAD_TIMEOUT: %v", bookID, err)
+	}
+}
+
+func (r *Reindexer) reindexBook(ctx context.Context, bookID, claim, model string, status *models.ReindexStatus, progress func(models.ReindexStatus)) error {
+	dim := 0
+	batch := make(map[primitive.ObjectID][]float32, reindexBatchSize)
+
+	flush := func() error {
+		if err := r.store.SetShadowEmbeddings(ctx, batch); err != nil {
+			return err
+		}
+		// long reindexes stay newer than the cleanup cutoff
+		if err := r.store.TouchBook(ctx, bookID); err != nil {
+			return err
+		}
+		status.ProcessedChunks += len(batch)
+		clear(batch)
+		if progress != nil {
+			progress(*status)
+		}
+		return nil
+	}
+
+	err := r.store.StreamChunks(ctx, bookID, func(chunk models.Chunk) error {
+		embedding, err := r.embedder.EmbedDocument(chunk.Text, model)
+		if err != nil {
+			return fmt.Errorf("failed to embed chunk %d: %w", chunk.ChunkIndex, err)
+		}
+		if dim == 0 {
+			dim = len(embedding)
+		} else if len(embedding) != dim {
+			return fmt.Errorf("model %s returned %d-dim embedding for chunk %d, expected %d", model, len(embedding), chunk.ChunkIndex, dim)
+		}
+
+		batch[chunk.ID] = embedding
+		if len(batch) >= reindexBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	swapped, err := r.store.SwapShadowEmbeddings(ctx, bookID, claim, model, dim)
+	if err != nil {
+		return err
+	}
+	log.Printf("Swapped %d embeddings for book %s to %s (dim %d)", swapped, bookID, model, dim)
+	return nil
+}
+
+// Start runs a reindex in the background and returns a job ID to poll with Status
+// returns ErrReindexRunning if a running job already covers the book, an empty bookID covers every book
+func (r *Reindexer) Start(bookID, model string) (string, error) {
+	if model == "" {
+		model = r.embedder.Model
+	}
+
+	r.mu.Lock()
+	r.pruneJobs()
+	for _, job := range r.jobs {
+		if job.Status == "running" && (job.BookID == "" || bookID == "" || job.BookID == bookID) {
+			r.mu.Unlock()
+			return "", ErrReindexRunning
+		}
+	}
+	jobID := primitive.NewObjectID().Hex()
+	r.jobs[jobID] = &models.ReindexStatus{
+		JobID:     jobID,
+		BookID:    bookID,
+		Model:     model,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	r.mu.Unlock()
+
+	go func() {
+		err := r.Reindex(context.Background(), bookID, model, func(s models.ReindexStatus) {
+			s.JobID = jobID
+			r.setStatus(jobID, s)
+		})
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		job := r.jobs[jobID]
+		finished := time.Now()
+		job.FinishedAt = &finished
+		if err != nil {
+			log.Printf("Reindex job %s failed: %v", jobID, err)
+			job.Status = "failed"
+			job.Error = err.Error()
+			return
+		}
+		job.Status = "completed"
+	}()
+
+	return jobID, nil
+}
+
+// drop finished jobs older than reindexJobTTL, and the oldest beyond maxFinishedReindexJobs
+// the caller holds r.mu
+func (r *Reindexer) pruneJobs() {
+	var finished []*models.ReindexStatus
+	for jobID, job := range r.jobs {
+		if job.FinishedAt == nil {
+			continue
+		}
+		if time.Since(*job.FinishedAt) > reindexJobTTL {
+			delete(r.jobs, jobID)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= maxFinishedReindexJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedReindexJobs] {
+		delete(r.jobs, job.JobID)
+	}
+}
+
+// Status returns a snapshot of a background reindex job
+func (r *Reindexer) Status(jobID string) (models.ReindexStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return models.ReindexStatus{}, false
+	}
+	return *job, true
+}
+
+func (r *Reindexer) setStatus(jobID string, status models.ReindexStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[jobID] = &status
+}
@@ -3,6 +3,8 @@ package services
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/blavejr/bowattAI/models"
 	"github.com/blavejr/bowattAI/storage"
@@ -13,29 +15,156 @@ import (
 // 2. Finding chunks with similar embeddings using cosine similarity
 // 3. Returning the top-K most similar chunks
 type Retriever struct {
-	store    *storage.MongoStore
-	embedder *Embedder
+	store     *storage.MongoStore
+	embedder  *Embedder
+	generator *Generator // writes hypothetical answers and paraphrases for query expansion, may be nil
 }
 
-func NewRetriever(store *storage.MongoStore, embedder *Embedder) *Retriever {
+func NewRetriever(store *storage.MongoStore, embedder *Embedder, generator *Generator) *Retriever {
 	return &Retriever{
-		store:    store,
-		embedder: embedder,
+		store:     store,
+		embedder:  embedder,
+		generator: generator,
 	}
 }
 
 // Retrieve finds the most relevant chunks for a query
 func (r *Retriever) Retrieve(ctx context.Context, query string, topK int, bookID string) ([]models.SearchResult, error) {
-	queryEmbedding, err := r.embedder.GenerateEmbedding(query)
+	return r.RetrieveFiltered(ctx, query, topK, bookID, nil)
+}
+
+// RetrieveFiltered finds the most relevant chunks among those whose metadata matches the filter
+func (r *Retriever) RetrieveFiltered(ctx context.Context, query string, topK int, bookID string, filter *models.ChunkFilter) ([]models.SearchResult, error) {
+	queryEmbedding, snapshot, _, err := r.embed(ctx, query, bookID, TaskQuery)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate query embedding: %w", err)
+		return nil, err
 	}
+	return r.search(ctx, queryEmbedding, snapshot, topK, bookID, filter)
+}
 
-	// search for similar chunks using vector similarity
-	results, err := r.store.SimpleVectorSearch(ctx, queryEmbedding, topK, bookID)
+// embed text with the same model the book was indexed with
+// returns the embedding, the snapshot the model was read from, which the search scores against, and the model used
+func (r *Retriever) embed(ctx context.Context, text, bookID string, task EmbeddingTask) ([]float32, *storage.EmbeddingSnapshot, string, error) {
+	var bookIDs []string
+	if bookID != "" {
+		bookIDs = []string{bookID}
+	}
+	snapshot, err := r.store.SnapshotEmbeddings(ctx, bookIDs)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to look up book embedding model: %w", err)
+	}
+
+	model := r.embedder.Model
+	expectedDim := 0
+	if bookID != "" {
+		book := snapshot.Book(bookID)
+		if book.Model != "" {
+			model = book.Model
+		}
+		expectedDim = book.Dim
+	}
+
+	var embedding []float32
+	if task == TaskDocument {
+		embedding, err = r.embedder.EmbedDocument(text, model)
+	} else {
+		embedding, err = r.embedder.EmbedQuery(text, model)
+	}
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to generate query embedding: %w", err)
+	}
+
+	if expectedDim > 0 && len(embedding) != expectedDim {
+		return nil, nil, "", fmt.Errorf("embedding dimension mismatch: book %s has %d-dim embeddings, model %s produced %d", bookID, expectedDim, model, len(embedding))
+	}
+	return embedding, snapshot, model, nil
+}
+
+// search for similar chunks using vector similarity, scoring them against the snapshot the embedding was made for
+func (r *Retriever) search(ctx context.Context, embedding []float32, snapshot *storage.EmbeddingSnapshot, topK int, bookID string, filter *models.ChunkFilter) ([]models.SearchResult, error) {
+	results, err := r.store.FilteredVectorSearch(ctx, embedding, topK, bookID, filter, snapshot)
 	if err != nil {
 		return nil, fmt.Errorf("vector search failed: %w", err)
 	}
+	return results, nil
+}
+
+// RetrieveLibrary finds the most relevant chunks across every book matching the filter
+// scores are normalised per book, as standard deviations above that book's mean, so a long book
+// with many loosely similar chunks doesn't crowd out a short one with a single good match
+func (r *Retriever) RetrieveLibrary(ctx context.Context, query string, topK int, filter storage.LibraryFilter) ([]models.SearchResult, error) {
+	bookIDs, err := r.store.FindBookIDs(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(bookIDs) == 0 {
+		return nil, nil
+	}
+
+	// books embedded with different models need their own query embedding
+	snapshot, err := r.store.SnapshotEmbeddings(ctx, bookIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up book embedding models: %w", err)
+	}
+	groups := make(map[string][]string)
+	for _, bookID := range bookIDs {
+		model := r.embedder.Model
+		if book := snapshot.Book(bookID); book.Model != "" {
+			model = book.Model
+		}
+		groups[model] = append(groups[model], bookID)
+	}
 
+	var results []models.SearchResult
+	for model, ids := range groups {
+		queryEmbedding, err := r.embedder.EmbedQuery(query, model)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate query embedding: %w", err)
+		}
+
+		books, err := r.store.SearchBooks(ctx, queryEmbedding, topK, ids, filter.Chunks, snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("vector search failed: %w", err)
+		}
+		// a book whose scores have no spread (a single chunk, or a filter leaving one) can't be normalised
+		// against itself, so it is scored against every chunk searched with this query embedding instead
+		pooledMean, pooledStdDev := pooledScoreStats(books)
+		for _, book := range books {
+			mean, stdDev := book.Mean, book.StdDev
+			if stdDev == 0 {
+				mean, stdDev = pooledMean, pooledStdDev
+			}
+			for _, result := range book.Results {
+				// with no spread at all every chunk scored the same, and 0 ranks them equally
+				if stdDev > 0 {
+					result.NormalizedScore = (result.Score - mean) / stdDev
+				}
+				results = append(results, result)
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].NormalizedScore > results[j].NormalizedScore
+	})
+	if len(results) > topK {
+		results = results[:topK]
+	}
 	return results, nil
 }
+
+// mean and standard deviation of the scores of every chunk scanned across books
+func pooledScoreStats(books []models.BookSearchResult) (float64, float64) {
+	var n, sum, sumSq float64
+	for _, book := range books {
+		count := float64(book.Scanned)
+		n += count
+		sum += count * book.Mean
+		sumSq += count * (book.StdDev*book.StdDev + book.Mean*book.Mean)
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	mean := sum / n
+	return mean, math.Sqrt(math.Max(sumSq/n-mean*mean, 0))
+}
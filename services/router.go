@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// how a question is answered
+const (
+	RouteMetadata  = "metadata"  // from the book's title, author and size
+	RouteRetrieval = "retrieval" // from the top-K chunks
+	RouteSummary   = "summary"   // from a summary of the book or some chapters
+	RouteMultiHop  = "multi_hop" // from evidence gathered for several sub-questions
+)
+
+// IsRoute reports whether name is a known route
+func IsRoute(name string) bool {
+	switch name {
+	case RouteMetadata, RouteRetrieval, RouteSummary, RouteMultiHop:
+		return true
+	}
+	return false
+}
+
+// RouteDecision is the route chosen for a question and why
+type RouteDecision struct {
+	Route  string
+	Reason string
+	// chapter range for the summary route, 0 when open-ended
+	ChapterFrom int
+	ChapterTo   int
+}
+
+type routeRule struct {
+	route   string
+	pattern *regexp.Regexp
+	reason  string
+}
+
+// checked in order, the first match wins
+var routeRules = []routeRule{
+	{RouteMetadata, regexp.MustCompile(`(?i)\b(who (wrote|is the author|authored)|author of|written by|title of|what is the (book|novel)('s)? (called|title|named)|how many (chapters|words|chunks|pages)|how long is (the|this) (book|novel)|when was (it|the book|this book) uploaded)\b`), "asks about the book itself"},
+	{RouteSummary, regexp.MustCompile(`(?i)\b(summari[sz]e|summary|overview|outline|recap|synopsis|what (is|'s) (the|this) (book|novel|story) about|main (themes?|plot|ideas?)|what happens in (chapter|chapters|the book|the novel))\b`), "asks for a summary"},
+	{RouteMultiHop, regexp.MustCompile(`(?i)\b(compare|comparison|contrast|difference between|differ(s)? from|change(s|d)? (between|from|over|throughout)|evolve(s|d)?|develop(s|ed)? (between|over|throughout)|before and after|relationship between .+ and)\b`), "needs evidence from several places"},
+}
+
+var (
+	chapterRangePattern  = regexp.MustCompile(`(?i)\bchapters? (\d+|[IVXLC]+)\s*(?:-|–|to|through|and)\s*(\d+|[IVXLC]+)\b`)
+	singleChapterPattern = regexp.MustCompile(`(?i)\bchapter (\d+|[IVXLC]+)\b`)
+)
+
+// Router decides how a question should be answered
+// 1. Matching the question against rules for metadata, summary and multi-hop questions
+// 2. Optionally asking the LLM to classify questions no rule matches
+// 3. Falling back to chunk retrieval
+type Router struct {
+	generator *Generator
+}
+
+func NewRouter(generator *Generator) *Router {
+	return &Router{generator: generator}
+}
+
+// Route classifies a question, useLLM lets the LLM classify questions the rules don't match
+func (r *Router) Route(ctx context.Context, question string, useLLM bool) RouteDecision {
+	decision := RouteDecision{Route: RouteRetrieval, Reason: "no rule matched"}
+
+	matched := false
+	for _, rule := range routeRules {
+		if rule.pattern.MatchString(question) {
+			decision = RouteDecision{Route: rule.route, Reason: rule.reason}
+			matched = true
+			break
+		}
+	}
+
+	if !matched && useLLM {
+		if route, err := r.classify(ctx, question); err == nil {
+			decision = RouteDecision{Route: route, Reason: "classified by the LLM"}
+		} else {
+			decision.Reason = fmt.Sprintf("no rule matched, LLM classification failed: %v", err)
+		}
+	}
+
+	if decision.Route == RouteSummary {
+		decision.ChapterFrom, decision.ChapterTo = ChapterRange(question)
+	}
+	return decision
+}
+
+// ask the LLM which route fits the question
+func (r *Router) classify(ctx context.Context, question string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("Classify the question about a book into exactly one category:\n")
+	sb.WriteString("metadata - about the book itself: its title, author, length or number of chapters\n")
+	sb.WriteString("summary - asks for a summary or overview of the book or of whole chapters\n")
+	sb.WriteString("multi_hop - needs facts from several different parts of the book, e.g. comparisons or changes over time\n")
+	sb.WriteString("retrieval - about a specific detail that a single passage can answer\n\n")
+	sb.WriteString(fmt.Sprintf("Question: %s\n\n", question))
+	sb.WriteString("Answer with the category name only.\nCategory:")
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	response, err := r.generator.CompletePrompt(ctx, sb.String())
+	if err != nil {
+		return "", err
+	}
+
+	answer := strings.ToLower(strings.TrimSpace(response))
+	for _, route := range []string{RouteMultiHop, RouteMetadata, RouteSummary, RouteRetrieval} {
+		if strings.Contains(answer, route) || strings.Contains(answer, strings.ReplaceAll(route, "_", "-")) {
+			return route, nil
+		}
+	}
+	return "", fmt.Errorf("unrecognised category %q", response)
+}
+
+// ChapterRange extracts "chapter 3" or "chapters 2 to 5" from a question, 0 when not mentioned
+func ChapterRange(question string) (int, int) {
+	if m := chapterRangePattern.FindStringSubmatch(question); m != nil {
+		from, to := parseChapterNumber(m[1]), parseChapterNumber(m[2])
+		if from > 0 && to >= from {
+			return from, to
+		}
+	}
+	if m := singleChapterPattern.FindStringSubmatch(question); m != nil {
+		if n := parseChapterNumber(m[1]); n > 0 {
+			return n, n
+		}
+	}
+	return 0, 0
+}
+
+// AnswerMetadata answers a question about the book itself from its stored details
+func AnswerMetadata(question string, book *models.Book) string {
+	q := strings.ToLower(question)
+	title := book.Title
+	if title == "" {
+		title = "the book"
+	}
+	// title at the start of a sentence, upper-casing the first rune rather than the first byte
+	first, size := utf8.DecodeRuneInString(title)
+	subject := string(unicode.ToUpper(first)) + title[size:]
+
+	switch {
+	case strings.Contains(q, "chapter"):
+		if book.Chapters == 0 {
+			return fmt.Sprintf("No chapter headings were detected in %s.", title)
+		}
+		return fmt.Sprintf("%s has %d chapters.", subject, book.Chapters)
+	case strings.Contains(q, "how many") || strings.Contains(q, "how long"):
+		words := book.TotalChars / 6 // about five letters and a space per English word
+		return fmt.Sprintf("%s is about %d characters long (roughly %d words), stored as %d chunks.", subject, book.TotalChars, words, book.TotalChunks)
+	case strings.Contains(q, "uploaded"):
+		return fmt.Sprintf("%s was uploaded on %s.", subject, book.UploadedAt.Format("2 January 2006"))
+	case strings.Contains(q, "title") || strings.Contains(q, "called") || strings.Contains(q, "named"):
+		if book.Title == "" {
+			return "The book was uploaded without a title."
+		}
+		return fmt.Sprintf("The book is titled %q.", book.Title)
+	case book.Author == "":
+		return fmt.Sprintf("The author of %s was not given when it was uploaded.", title)
+	default:
+		return fmt.Sprintf("%s was written by %s.", subject, book.Author)
+	}
+}
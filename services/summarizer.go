@@ -0,0 +1,289 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/storage"
+)
+
+// length of the final summary when the request doesn't ask for one
+const DefaultSummaryWords = 300
+
+// ErrNoChunks is returned when there is nothing to summarize
+var ErrNoChunks = errors.New("no chunks to summarize")
+
+// Summarizer builds book and chapter summaries that top-K retrieval can't answer
+// 1. Map: summarizing runs of consecutive chunks that fit the token budget, never crossing a chapter
+// 2. Reduce: summarizing runs of those summaries, level by level, until one remains
+// 3. Rewriting the last summary to the requested length
+// every section is cached per book, so later requests only pay for what they haven't seen
+type Summarizer struct {
+	store     *storage.MongoStore
+	generator *Generator
+	budget    int
+}
+
+func NewSummarizer(store *storage.MongoStore, generator *Generator, budget int) *Summarizer {
+	return &Summarizer{
+		store:     store,
+		generator: generator,
+		budget:    budget,
+	}
+}
+
+// a run of chunks and the text that summarizes it at the current level
+type summarySection struct {
+	firstChunk int
+	lastChunk  int
+	chapter    int // 0 when the section spans chapters or the book has none
+	text       string
+}
+
+// Summarize produces a summary of a book or a range of its chapters
+func (s *Summarizer) Summarize(ctx context.Context, bookID string, req models.SummarizeRequest) (*models.SummarizeResponse, error) {
+	chunks, err := s.store.GetChunksByBookID(ctx, bookID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ChapterFrom > 0 || req.ChapterTo > 0 {
+		chunks = filterChapters(chunks, req.ChapterFrom, req.ChapterTo)
+	}
+	if len(chunks) == 0 {
+		return nil, ErrNoChunks
+	}
+
+	targetWords := req.TargetWords
+	if targetWords <= 0 {
+		targetWords = DefaultSummaryWords
+	}
+
+	title := chunks[0].Metadata.BookTitle
+	author := chunks[0].Metadata.BookAuthor
+	response := &models.SummarizeResponse{
+		BookID:      bookID,
+		ChapterFrom: req.ChapterFrom,
+		ChapterTo:   req.ChapterTo,
+		TargetWords: targetWords,
+		Chunks:      len(chunks),
+		Model:       s.generator.Model,
+	}
+
+	// map
+	sections := s.chunkSections(chunks)
+	log.Printf("Summarizing book %s: %d chunks in %d sections", bookID, len(chunks), len(sections))
+	for i := range sections {
+		prompt := mapPrompt(title, author, sections[i])
+		if sections[i].text, err = s.section(ctx, bookID, 0, sections[i], 0, prompt, req.Refresh, response); err != nil {
+			return nil, err
+		}
+	}
+
+	// reduce
+	level := 0
+	for len(sections) > 1 {
+		level++
+		groups := s.groupSections(sections)
+		next := make([]summarySection, len(groups))
+		for i, group := range groups {
+			next[i] = summarySection{
+				firstChunk: group[0].firstChunk,
+				lastChunk:  group[len(group)-1].lastChunk,
+				chapter:    sharedChapter(group),
+			}
+			prompt := reducePrompt(title, author, group)
+			if next[i].text, err = s.section(ctx, bookID, level, next[i], 0, prompt, req.Refresh, response); err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("Summarizing book %s: level %d has %d sections", bookID, level, len(next))
+		sections = next
+	}
+
+	// final rewrite to the requested length
+	level++
+	prompt := finalPrompt(title, author, sections[0], targetWords)
+	summary, err := s.section(ctx, bookID, level, sections[0], targetWords, prompt, req.Refresh, response)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Summary = summary
+	response.Levels = level + 1
+	return response, nil
+}
+
+// return the cached summary of a section, or generate and cache it
+func (s *Summarizer) section(ctx context.Context, bookID string, level int, section summarySection, targetWords int, prompt string, refresh bool, response *models.SummarizeResponse) (string, error) {
+	key := &models.Summary{
+		BookID:      bookID,
+		Level:       level,
+		FirstChunk:  section.firstChunk,
+		LastChunk:   section.lastChunk,
+		TargetWords: targetWords,
+		Model:       s.generator.Model,
+	}
+	response.Sections++
+
+	if !refresh {
+		cached, err := s.store.GetSummary(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		if cached != nil {
+			response.CachedSections++
+			return cached.Text, nil
+		}
+	}
+
+	text, err := s.generator.CompletePrompt(ctx, prompt)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize chunks %d-%d: %w", section.firstChunk, section.lastChunk, err)
+	}
+	if text == "" {
+		return "", fmt.Errorf("received empty summary for chunks %d-%d", section.firstChunk, section.lastChunk)
+	}
+
+	key.Text = text
+	if err := s.store.SaveSummary(ctx, key); err != nil {
+		// the summary is still usable, it just won't be reused
+		log.Printf("Failed to cache summary of book %s chunks %d-%d: %v", bookID, section.firstChunk, section.lastChunk, err)
+	}
+	return text, nil
+}
+
+// group consecutive chunks into sections that fit the budget and stay within one chapter
+// sections always start at a chapter boundary, so a chapter's sections are the same whatever range is requested
+func (s *Summarizer) chunkSections(chunks []models.Chunk) []summarySection {
+	var sections []summarySection
+	var current *summarySection
+	var sb strings.Builder
+	tokens := 0
+
+	flush := func() {
+		if current != nil {
+			current.text = sb.String()
+			sections = append(sections, *current)
+		}
+		current = nil
+		sb.Reset()
+		tokens = 0
+	}
+
+	for _, chunk := range chunks {
+		chunkTokens := EstimateTokens(chunk.Text)
+		if current != nil && (chunk.Metadata.Chapter != current.chapter || tokens+chunkTokens > s.budget) {
+			flush()
+		}
+		if current == nil {
+			current = &summarySection{firstChunk: chunk.ChunkIndex, chapter: chunk.Metadata.Chapter}
+		}
+		current.lastChunk = chunk.ChunkIndex
+		sb.WriteString(chunk.Text)
+		sb.WriteString("\n\n")
+		tokens += chunkTokens
+	}
+	flush()
+
+	return sections
+}
+
+// group consecutive summaries so each group fits the budget, with at least two per group so every level shrinks
+func (s *Summarizer) groupSections(sections []summarySection) [][]summarySection {
+	var groups [][]summarySection
+	var group []summarySection
+	tokens := 0
+	for _, section := range sections {
+		sectionTokens := EstimateTokens(section.text)
+		if len(group) >= 2 && tokens+sectionTokens > s.budget {
+			groups = append(groups, group)
+			group = nil
+			tokens = 0
+		}
+		group = append(group, section)
+		tokens += sectionTokens
+	}
+	// a lone leftover joins the previous group rather than being summarized on its own
+	if len(group) == 1 && len(groups) > 0 {
+		groups[len(groups)-1] = append(groups[len(groups)-1], group[0])
+	} else if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// keep chunks whose chapter is within [from, to], either bound may be 0 for open-ended
+func filterChapters(chunks []models.Chunk, from, to int) []models.Chunk {
+	var filtered []models.Chunk
+	for _, chunk := range chunks {
+		chapter := chunk.Metadata.Chapter
+		if chapter == 0 || (from > 0 && chapter < from) || (to > 0 && chapter > to) {
+			continue
+		}
+		filtered = append(filtered, chunk)
+	}
+	return filtered
+}
+
+// the chapter every section in the group belongs to, or 0
+func sharedChapter(group []summarySection) int {
+	chapter := group[0].chapter
+	for _, section := range group[1:] {
+		if section.chapter != chapter {
+			return 0
+		}
+	}
+	return chapter
+}
+
+func describeBook(title, author string, chapter int) string {
+	desc := "a book"
+	if title != "" {
+		desc = fmt.Sprintf("%q", title)
+		if author != "" {
+			desc += " by " + author
+		}
+	}
+	if chapter > 0 {
+		desc = fmt.Sprintf("chapter %d of %s", chapter, desc)
+	}
+	return desc
+}
+
+func mapPrompt(title, author string, section summarySection) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Summarize the following passage from %s. ", describeBook(title, author, section.chapter)))
+	sb.WriteString("Keep the important events, characters, ideas and their order. ")
+	sb.WriteString("Write a single paragraph and use only information from the passage.\n\n")
+	sb.WriteString("Passage:\n---\n")
+	sb.WriteString(section.text)
+	sb.WriteString("---\n\nSummary:")
+	return sb.String()
+}
+
+func reducePrompt(title, author string, group []summarySection) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("The following are summaries of consecutive parts of %s, in order. ", describeBook(title, author, sharedChapter(group))))
+	sb.WriteString("Combine them into one coherent summary that keeps the important events, characters and ideas in order. ")
+	sb.WriteString("Use only information from the summaries.\n\n")
+	for i, section := range group {
+		sb.WriteString(fmt.Sprintf("Part %d:\n%s\n\n", i+1, section.text))
+	}
+	sb.WriteString("Combined summary:")
+	return sb.String()
+}
+
+func finalPrompt(title, author string, section summarySection, targetWords int) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Rewrite the following summary of %s in about %d words. ", describeBook(title, author, section.chapter), targetWords))
+	sb.WriteString("Keep the most important events, characters and ideas, and do not add anything that isn't in the summary.\n\n")
+	sb.WriteString("Summary:\n---\n")
+	sb.WriteString(section.text)
+	sb.WriteString("\n---\n\nRewritten summary:")
+	return sb.String()
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/blavejr/bowattAI/models"
+)
+
+// built-in template, used when the templates directory doesn't override "default"
+const defaultPromptTemplate = `You are a helpful assistant answering questions about a book.
+Use ONLY the following context passages to answer the question.
+If the answer cannot be found in the context, say "I cannot find this information in the provided text."
+Be concise and accurate. Cite specific details from the context when possible.
+After each sentence, cite the passages it is based on by their number in square brackets, e.g. [1] or [2][3].
+Only cite passage numbers that appear in the context.
+
+Context:
+---
+{{range .Contexts}}[{{.Number}}] {{if $.CrossBook}}({{.Title}}{{if .Author}} by {{.Author}}{{end}}) {{end}}{{.Text}}
+
+{{end}}---
+
+{{if .History}}Conversation so far:
+{{range .History}}{{if eq .Role "assistant"}}Assistant{{else}}User{{end}}: {{.Content}}
+{{end}}
+{{end}}Question: {{.Question}}
+
+Answer:`
+
+// PromptData is what prompt templates can refer to
+type PromptData struct {
+	Question string
+	Contexts []PromptContext
+	History  []models.Message
+	// the passages come from more than one book
+	CrossBook bool
+}
+
+// PromptContext is a retrieved passage with its metadata
+type PromptContext struct {
+	Number         int // 1-based, the [n] used for citations
+	ChunkID        string
+	Text           string
+	Title          string
+	Author         string
+	Chapter        int
+	ChunkIndex     int
+	CharacterStart int
+	CharacterEnd   int
+	Score          float64
+}
+
+// ContextsFromResults numbers retrieved chunks for the prompt
+func ContextsFromResults(results []models.SearchResult) []PromptContext {
+	contexts := make([]PromptContext, len(results))
+	for i, result := range results {
+		contexts[i] = PromptContext{
+			Number:         i + 1,
+			ChunkID:        result.Chunk.ID.Hex(),
+			Text:           result.Chunk.Text,
+			Title:          result.Chunk.Metadata.BookTitle,
+			Author:         result.Chunk.Metadata.BookAuthor,
+			Chapter:        result.Chunk.Metadata.Chapter,
+			ChunkIndex:     result.Chunk.ChunkIndex,
+			CharacterStart: result.Chunk.Metadata.CharacterStart,
+			CharacterEnd:   result.Chunk.Metadata.CharacterEnd,
+			Score:          result.Score,
+		}
+	}
+	return contexts
+}
+
+// contexts without metadata, for callers that only have text
+func contextsFromText(texts []string) []PromptContext {
+	contexts := make([]PromptContext, len(texts))
+	for i, text := range texts {
+		contexts[i] = PromptContext{Number: i + 1, Text: text}
+	}
+	return contexts
+}
+
+// PromptTemplates holds the named prompt templates
+type PromptTemplates struct {
+	templates   map[string]*template.Template
+	defaultName string
+}
+
+// LoadPromptTemplates parses every *.tmpl file in dir, named after the file without extension
+// each template is rendered with sample data so mistakes are caught at startup
+// a missing directory is not an error, the built-in "default" template is always available
+func LoadPromptTemplates(dir, defaultName string) (*PromptTemplates, error) {
+	pt := &PromptTemplates{
+		templates:   make(map[string]*template.Template),
+		defaultName: defaultName,
+	}
+
+	builtin, err := template.New("default").Option("missingkey=error").Parse(defaultPromptTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse built-in prompt template: %w", err)
+	}
+	pt.templates["default"] = builtin
+
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list prompt templates: %w", err)
+		}
+		if len(paths) == 0 {
+			if _, statErr := os.Stat(dir); statErr != nil {
+				log.Printf("Prompt templates directory %s not found, using built-in template", dir)
+			}
+		}
+
+		for _, path := range paths {
+			name := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read prompt template %s: %w", path, err)
+			}
+			tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+			if err != nil {
+				return nil, fmt.Errorf("invalid prompt template %s: %w", path, err)
+			}
+			pt.templates[name] = tmpl
+		}
+	}
+
+	if _, ok := pt.templates[defaultName]; !ok {
+		return nil, fmt.Errorf("default prompt template %q not found (available: %s)", defaultName, strings.Join(pt.Names(), ", "))
+	}
+
+	sample := PromptData{
+		Question: "Who is the main character?",
+		Contexts: []PromptContext{{Number: 1, Text: "Sample passage.", Title: "Title", Author: "Author", Chapter: 1}},
+		History:  []models.Message{{Role: "user", Content: "Hello"}, {Role: "assistant", Content: "Hi"}},
+	}
+	for name := range pt.templates {
+		if _, err := pt.Render(name, sample); err != nil {
+			return nil, fmt.Errorf("invalid prompt template %s: %w", name, err)
+		}
+	}
+
+	log.Printf("Loaded prompt templates: %s (default: %s)", strings.Join(pt.Names(), ", "), defaultName)
+	return pt, nil
+}
+
+// Has reports whether a template with this name exists
+func (pt *PromptTemplates) Has(name string) bool {
+	_, ok := pt.templates[name]
+	return ok
+}
+
+// Names lists the available templates
+func (pt *PromptTemplates) Names() []string {
+	names := make([]string, 0, len(pt.templates))
+	for name := range pt.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render executes the named template, or the default one if name is empty
+func (pt *PromptTemplates) Render(name string, data PromptData) (string, error) {
+	if name == "" {
+		name = pt.defaultName
+	}
+	tmpl, ok := pt.templates[name]
+	if !ok {
+		return "", fmt.Errorf("prompt template %q not found", name)
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %w", name, err)
+	}
+	return sb.String(), nil
+}
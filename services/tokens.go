@@ -0,0 +1,13 @@
+package services
+
+import "unicode/utf8"
+
+// EstimateTokens approximates the number of LLM tokens in text
+// roughly 4 characters per token for English prose, good enough for budgeting
+func EstimateTokens(text string) int {
+	n := utf8.RuneCountInString(text)
+	if n == 0 {
+		return 0
+	}
+	return (n + 3) / 4
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// answer given instead of one that fails verification in strict mode
+const RefusalAnswer = "I cannot give a well-supported answer to this question from the provided text."
+
+// a claim is lexically supported when this share of its content words appear in one passage
+const lexicalSupportThreshold = 0.6
+
+var stopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true, "you": true,
+	"all": true, "any": true, "can": true, "her": true, "was": true, "one": true, "our": true,
+	"out": true, "his": true, "has": true, "had": true, "him": true, "she": true, "they": true,
+	"them": true, "this": true, "that": true, "with": true, "have": true, "from": true,
+	"were": true, "been": true, "their": true, "there": true, "which": true, "would": true,
+	"what": true, "when": true, "who": true, "will": true, "into": true, "than": true,
+	"then": true, "also": true, "its": true, "about": true, "does": true, "did": true,
+	"very": true, "some": true, "such": true, "only": true, "most": true, "more": true,
+	"these": true, "those": true, "being": true, "because": true, "while": true,
+	"text": true, "passage": true, "context": true, "book": true,
+}
+
+// Verification is the outcome of checking an answer against its passages
+type Verification struct {
+	GroundedScore        float64  // share of claims supported by the passages, 1 if there are none
+	UnsupportedSentences []string // claims no passage supports
+	Claims               int
+}
+
+// Verifier checks whether generated answers are supported by the retrieved passages
+// 1. Splitting the answer into sentence-level claims
+// 2. Checking each claim for lexical overlap with the passages
+// 3. Optionally asking the LLM whether the passages entail claims that failed step 2
+type Verifier struct {
+	generator *Generator
+}
+
+func NewVerifier(generator *Generator) *Verifier {
+	return &Verifier{generator: generator}
+}
+
+// Verify scores an answer against the passages it was generated from
+func (v *Verifier) Verify(ctx context.Context, answer string, contexts []PromptContext, useLLM bool) Verification {
+	passages := make([]map[string]bool, len(contexts))
+	for i, c := range contexts {
+		passages[i] = make(map[string]bool)
+		for _, word := range contentWords(c.Text) {
+			passages[i][word] = true
+		}
+	}
+
+	result := Verification{UnsupportedSentences: []string{}}
+	supported := 0
+	for _, sentence := range splitSentences(answer) {
+		claim := stripCitations(sentence)
+		words := contentWords(claim)
+		// refusals and filler like "In summary:" make no checkable claim
+		if len(words) == 0 || strings.HasPrefix(claim, "I cannot find") {
+			continue
+		}
+		result.Claims++
+
+		if lexicallySupported(words, passages) || (useLLM && v.entailed(ctx, claim, contexts)) {
+			supported++
+			continue
+		}
+		result.UnsupportedSentences = append(result.UnsupportedSentences, claim)
+	}
+
+	result.GroundedScore = 1
+	if result.Claims > 0 {
+		result.GroundedScore = float64(supported) / float64(result.Claims)
+	}
+	return result
+}
+
+func lexicallySupported(words []string, passages []map[string]bool) bool {
+	for _, passage := range passages {
+		found := 0
+		for _, word := range words {
+			if passage[word] {
+				found++
+			}
+		}
+		if float64(found)/float64(len(words)) >= lexicalSupportThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// ask the LLM whether the passages support the claim
+func (v *Verifier) entailed(ctx context.Context, claim string, contexts []PromptContext) bool {
+	var sb strings.Builder
+	sb.WriteString("Decide whether the claim is supported by the passages. ")
+	sb.WriteString("A claim is supported only if the passages state it or it follows directly from them.\n\n")
+	sb.WriteString("Passages:\n")
+	for _, c := range contexts {
+		sb.WriteString(fmt.Sprintf("[%d] %s\n\n", c.Number, c.Text))
+	}
+	sb.WriteString(fmt.Sprintf("Claim: %s\n\n", claim))
+	sb.WriteString("Answer with YES or NO only.\nAnswer:")
+
+	response, err := v.generator.CompletePrompt(ctx, sb.String())
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(response)), "YES")
+}
+
+// lowercased words of three or more letters that aren't stopwords
+func contentWords(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+
+	content := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.TrimSuffix(strings.Trim(word, "'"), "'s")
+		if len([]rune(word)) < 3 || stopwords[word] {
+			continue
+		}
+		content = append(content, word)
+	}
+	return content
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+	"github.com/blavejr/bowattAI/storage"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrUnchanged is returned when a new version has the same text as the current one
+var ErrUnchanged = errors.New("text is unchanged")
+
+// Versioner uploads new versions of a book, re-embedding only what changed
+// 1. Chunking the new text the same way as an upload, as it streams in
+// 2. Keeping chunks whose text and position are unchanged
+// 3. Copying the embedding of chunks whose text moved, embedding the rest
+// 4. Making the new version current, the old one stays queryable by version
+// one version of a book is stored at a time, the version number is claimed on the book first
+// the new text is handled batchSize chunks at a time, only the hashes and positions of the current chunks are held in memory
+type Versioner struct {
+	store     *storage.MongoStore
+	chunker   *Chunker
+	embedder  *Embedder
+	batchSize int
+}
+
+func NewVersioner(store *storage.MongoStore, chunker *Chunker, embedder *Embedder, batchSize int) *Versioner {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &Versioner{
+		store:     store,
+		chunker:   chunker,
+		embedder:  embedder,
+		batchSize: batchSize,
+	}
+}
+
+// AddVersion reads text from r and stores it as the next version of a book
+// contentHash is ContentHash of the text, computed beforehand like for uploads
+// returns storage.ErrBookBusy if another version of the book is being stored or it is being reindexed
+func (v *Versioner) AddVersion(ctx context.Context, bookID string, r io.Reader, contentHash string) (*models.BookVersion, error) {
+	book, err := v.store.ClaimVersion(ctx, bookID)
+	if err != nil {
+		if book != nil {
+			v.abort(ctx, book)
+		}
+		return nil, err
+	}
+	if book == nil {
+		return nil, fmt.Errorf("book %s not found", bookID)
+	}
+
+	version, err := v.addVersion(ctx, book, r, contentHash)
+	if err != nil {
+		v.abort(ctx, book)
+		return nil, err
+	}
+	return version, nil
+}
+
+// remove what a failed version wrote and release the claim on the book
+func (v *Versioner) abort(ctx context.Context, book *models.Book) {
+	if err := v.store.AbortVersion(ctx, book.ID, book.PendingVersion); err != nil {
+		log.Printf("ERROR: failed to roll back version %d of book %s, it stays pending until the cleanup after PENDING_UPLOAD_TIMEOUT: %v", book.PendingVersion, book.ID, err)
+	}
+}
+
+func (v *Versioner) addVersion(ctx context.Context, book *models.Book, r io.Reader, contentHash string) (*models.BookVersion, error) {
+	if contentHash == book.ContentHash {
+		return nil, ErrUnchanged
+	}
+
+	current, err := v.store.GetVersionChunks(ctx, book.ID)
+	if err != nil {
+		return nil, err
+	}
+	byIndex := make(map[int]models.Chunk, len(current))
+	byHash := make(map[string]primitive.ObjectID, len(current))
+	for _, chunk := range current {
+		if chunk.ContentHash == "" {
+			chunk.ContentHash = ChunkHash(chunk.Text)
+			chunk.Text = ""
+		}
+		byIndex[chunk.ChunkIndex] = chunk
+		byHash[chunk.ContentHash] = chunk.ID
+	}
+
+	model := book.EmbeddingModel
+	if model == "" {
+		model = v.embedder.Model
+	}
+
+	version := models.BookVersion{
+		Version:     book.PendingVersion,
+		ContentHash: contentHash,
+		UploadedAt:  time.Now(),
+	}
+
+	var chapters ChapterDetector
+	batch := make([]ChunkSpan, 0, v.batchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		var kept []primitive.ObjectID
+		var newChunks []models.Chunk
+		var copyFrom []primitive.ObjectID
+		for _, span := range batch {
+			i := version.TotalChunks
+			version.TotalChunks++
+			version.TotalChars = span.End
+
+			chapter := chapters.Next(span.Text)
+			version.Chapters = chapters.Chapters()
+
+			hash := ChunkHash(span.Text)
+			old, ok := byIndex[i]
+			if ok && old.ContentHash == hash && old.Metadata.HasOffsets && old.Metadata.CharacterStart == span.Start &&
+				old.Metadata.CharacterEnd == span.End && old.Metadata.Chapter == chapter {
+				kept = append(kept, old.ID)
+				continue
+			}
+
+			newChunks = append(newChunks, models.Chunk{
+				ID:          primitive.NewObjectID(),
+				BookID:      book.ID,
+				ChunkIndex:  i,
+				Text:        span.Text,
+				ContentHash: hash,
+				Versions:    []int{version.Version},
+				Metadata: models.ChunkMetadata{
+					BookTitle:      book.Title,
+					BookAuthor:     book.Author,
+					Chapter:        chapter,
+					CharacterStart: span.Start,
+					CharacterEnd:   span.End,
+					HasOffsets:     true,
+					ChunkSize:      len(span.Text),
+					PromptTemplate: book.PromptTemplate,
+					Tags:           book.Tags,
+				},
+				CreatedAt: time.Now(),
+			})
+			if id, ok := byHash[hash]; ok {
+				copyFrom = append(copyFrom, id)
+			}
+		}
+
+		// the same text elsewhere in the book embeds the same, whatever its position
+		copies, err := v.store.GetEmbeddings(ctx, copyFrom)
+		if err != nil {
+			return err
+		}
+		for j := range newChunks {
+			chunk := &newChunks[j]
+			if same, ok := copies[byHash[chunk.ContentHash]]; ok && len(same.Embedding) > 0 {
+				chunk.Embedding = same.Embedding
+				chunk.EmbeddingModel = same.EmbeddingModel
+				chunk.EmbeddingDim = same.EmbeddingDim
+				version.CopiedChunks++
+				continue
+			}
+
+			embedding, err := v.embedder.EmbedDocument(chunk.Text, model)
+			if err != nil {
+				return fmt.Errorf("failed to embed chunk %d: %w", chunk.ChunkIndex, err)
+			}
+			if book.EmbeddingDim > 0 && len(embedding) != book.EmbeddingDim {
+				return fmt.Errorf("embedding dimension mismatch: book %s has %d-dim embeddings, model %s produced %d", book.ID, book.EmbeddingDim, model, len(embedding))
+			}
+			chunk.Embedding = embedding
+			chunk.EmbeddingModel = model
+			chunk.EmbeddingDim = len(embedding)
+			version.EmbeddedChunks++
+		}
+
+		if len(newChunks) > 0 {
+			if err := v.store.InsertChunks(ctx, newChunks); err != nil {
+				return err
+			}
+		}
+		if err := v.store.KeepChunks(ctx, kept, version.Version); err != nil {
+			return err
+		}
+		version.KeptChunks += len(kept)
+		// long uploads stay newer than the pending cleanup cutoff
+		if err := v.store.TouchBook(ctx, book.ID); err != nil {
+			return err
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	err = v.chunker.ChunkReader(r, func(span ChunkSpan) error {
+		batch = append(batch, span)
+		if len(batch) < v.batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version.TotalChunks == 0 {
+		return nil, ErrEmptyText
+	}
+
+	if err := v.store.PublishVersion(ctx, book, version); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Stored version %d of book %s: %d chunks kept, %d copied, %d embedded",
+		version.Version, book.ID, version.KeptChunks, version.CopiedChunks, version.EmbeddedChunks)
+	return &version, nil
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrDuplicateBook is returned when another book without an original already has the same content
+var ErrDuplicateBook = errors.New("a book with the same content already exists")
+
+// insert the record of a newly uploaded book
+// returns ErrDuplicateBook if a book with the same content was inserted first
+func (s *MongoStore) InsertBook(ctx context.Context, book *models.Book) error {
+	if book.OriginalBookID == "" {
+		book.CanonicalHash = book.ContentHash
+	}
+	if _, err := s.books.InsertOne(ctx, book); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateBook
+		}
+		return fmt.Errorf("failed to insert book: %w", err)
+	}
+	return nil
+}
+
+// EnsureBookIndexes indexes books by content hash, unique among books that aren't deliberate copies
+func (s *MongoStore) EnsureBookIndexes(ctx context.Context) error {
+	// books uploaded before the unique index existed
+	missing := bson.M{
+		"content_hash":     bson.M{"$exists": true},
+		"original_book_id": bson.M{"$exists": false},
+		"canonical_hash":   bson.M{"$exists": false},
+	}
+	copyHash := mongo.Pipeline{bson.D{{Key: "$set", Value: bson.M{"canonical_hash": "$content_hash"}}}}
+	if _, err := s.books.UpdateMany(ctx, missing, copyHash); err != nil {
+		return fmt.Errorf("failed to record canonical hashes: %w", err)
+	}
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "content_hash", Value: 1}},
+			Options: options.Index().SetName("content_hash"),
+		},
+		{
+			Keys: bson.D{{Key: "canonical_hash", Value: 1}},
+			Options: options.Index().
+				SetName("canonical_hash_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"canonical_hash": bson.M{"$exists": true}}),
+		},
+	}
+	if _, err := s.books.Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("failed to create book indexes: %w", err)
+	}
+	return nil
+}
+
+// GetBook returns a book, or nil if it doesn't exist or hasn't finished uploading
+func (s *MongoStore) GetBook(ctx context.Context, bookID string) (*models.Book, error) {
+	var book models.Book
+	err := s.books.FindOne(ctx, readyBook(bookID)).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find book: %w", err)
+	}
+	return &book, nil
+}
+
+// FindBookByContentHash returns the first book uploaded with the given content, or nil if there is none
+func (s *MongoStore) FindBookByContentHash(ctx context.Context, hash string) (*models.Book, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "uploaded_at", Value: 1}})
+	var book models.Book
+	filter := bson.M{"content_hash": hash, "status": bson.M{"$ne": models.BookPending}}
+	err := s.books.FindOne(ctx, filter, opts).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find book by content: %w", err)
+	}
+	return &book, nil
+}
+
+// match a book unless it is still being uploaded, or was abandoned part way
+func readyBook(bookID string) bson.M {
+	return bson.M{"_id": bookID, "status": bson.M{"$ne": models.BookPending}}
+}
+
+// GetBooks lists every book that finished uploading, most recently uploaded first
+func (s *MongoStore) GetBooks(ctx context.Context) ([]models.Book, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "uploaded_at", Value: -1}})
+	cursor, err := s.books.Find(ctx, bson.M{"status": bson.M{"$ne": models.BookPending}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find books: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var books []models.Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, fmt.Errorf("failed to decode books: %w", err)
+	}
+	return books, nil
+}
+
+// UpdateBook changes the title, author or tags of a book and of its chunks' metadata
+// returns nil if the book doesn't exist or hasn't finished uploading
+func (s *MongoStore) UpdateBook(ctx context.Context, bookID string, req models.UpdateBookRequest) (*models.Book, error) {
+	bookSet := bson.M{"updated_at": time.Now()}
+	chunkSet := bson.M{}
+	if req.Title != nil {
+		bookSet["title"] = *req.Title
+		chunkSet["metadata.book_title"] = *req.Title
+	}
+	if req.Author != nil {
+		bookSet["author"] = *req.Author
+		chunkSet["metadata.book_author"] = *req.Author
+	}
+	if req.Tags != nil {
+		bookSet["tags"] = *req.Tags
+		chunkSet["metadata.tags"] = *req.Tags
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var book models.Book
+	err := s.books.FindOneAndUpdate(ctx, readyBook(bookID), bson.M{"$set": bookSet}, opts).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update book: %w", err)
+	}
+
+	// chunks carry a copy of the book's details for retrieval and filtering
+	if len(chunkSet) > 0 {
+		if _, err := s.collection.UpdateMany(ctx, bson.M{"book_id": bookID}, bson.M{"$set": chunkSet}); err != nil {
+			return nil, fmt.Errorf("failed to update chunk metadata: %w", err)
+		}
+	}
+	return &book, nil
+}
+
+// DeleteBook removes a book with its chunks and cached summaries, returns false if it doesn't exist
+func (s *MongoStore) DeleteBook(ctx context.Context, bookID string) (bool, error) {
+	chunks, err := s.CountBookChunks(ctx, bookID)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.books.DeleteOne(ctx, bson.M{"_id": bookID})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete book: %w", err)
+	}
+	if result.DeletedCount == 0 && chunks == 0 {
+		return false, nil
+	}
+
+	if err := s.DeleteChunksByBookID(ctx, bookID); err != nil {
+		return false, err
+	}
+	if err := s.DeleteSummaries(ctx, bookID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// BackfillBooks writes book records for books uploaded before the books collection existed
+// their details are rebuilt from the chunks, which have no versions as they predate versioning
+// chunks with versions but no book are left to CleanupPending, their upload was abandoned
+func (s *MongoStore) BackfillBooks(ctx context.Context) (int, error) {
+	distinct, err := s.collection.Distinct(ctx, "book_id", bson.M{"versions": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list books of chunks: %w", err)
+	}
+	var bookIDs []string
+	for _, id := range distinct {
+		if str, ok := id.(string); ok {
+			bookIDs = append(bookIDs, str)
+		}
+	}
+
+	created := 0
+	for _, bookID := range bookIDs {
+		count, err := s.books.CountDocuments(ctx, bson.M{"_id": bookID})
+		if err != nil {
+			return created, fmt.Errorf("failed to check book: %w", err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		book, err := s.bookFromChunks(ctx, bookID)
+		if err != nil {
+			return created, err
+		}
+		if book == nil {
+			continue
+		}
+		book.Status = models.BookReady
+		if err := s.InsertBook(ctx, book); err != nil {
+			return created, err
+		}
+		log.Printf("Created book record for %s (%s)", bookID, book.Title)
+		created++
+	}
+	return created, nil
+}
+
+// rebuild a book record from its chunks, nil if it has none
+// the chunk size and overlap it was uploaded with aren't recorded on chunks and stay zero
+func (s *MongoStore) bookFromChunks(ctx context.Context, bookID string) (*models.Book, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{"book_id": bookID}}},
+		bson.D{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$book_id"},
+				{Key: "title", Value: bson.D{{Key: "$first", Value: "$metadata.book_title"}}},
+				{Key: "author", Value: bson.D{{Key: "$first", Value: "$metadata.book_author"}}},
+				{Key: "total_chunks", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "total_chars", Value: bson.D{{Key: "$sum", Value: "$metadata.chunk_size"}}},
+				{Key: "tags", Value: bson.D{{Key: "$first", Value: "$metadata.tags"}}},
+				{Key: "prompt_template", Value: bson.D{{Key: "$first", Value: "$metadata.prompt_template"}}},
+				{Key: "embedding_model", Value: bson.D{{Key: "$first", Value: "$embedding_model"}}},
+				{Key: "embedding_dim", Value: bson.D{{Key: "$first", Value: "$embedding_dim"}}},
+				{Key: "uploaded_at", Value: bson.D{{Key: "$min", Value: "$created_at"}}},
+			}},
+		},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate book: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var books []models.Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, fmt.Errorf("failed to decode book: %w", err)
+	}
+	if len(books) == 0 {
+		return nil, nil
+	}
+	book := &books[0]
+
+	var chapters models.ChapterCount
+	err = s.StreamChunks(ctx, bookID, func(chunk models.Chunk) error {
+		chapters.Add(chunk.Metadata.Chapter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	book.Chapters = chapters.Chapters
+
+	return book, nil
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChunkQuery selects a page of a book's chunks
+type ChunkQuery struct {
+	After      int // only chunks with a higher chunk_index, -1 for the first page
+	Limit      int
+	Text       string // case-insensitive substring of the chunk text
+	Embeddings bool
+	Version    int // the current version when 0
+}
+
+// leave out the vectors unless they are asked for, they dwarf the rest of a chunk
+func chunkProjection(embeddings bool) bson.M {
+	if embeddings {
+		return bson.M{"embedding_next": 0}
+	}
+	return bson.M{"embedding": 0, "embedding_next": 0}
+}
+
+// ListChunks returns a page of a book's chunks in chunk order and how many chunks match in total
+func (s *MongoStore) ListChunks(ctx context.Context, bookID string, q ChunkQuery) ([]models.Chunk, int64, error) {
+	filter, err := s.visibleChunks(ctx, []string{bookID}, q.Version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if q.Text != "" {
+		filter["text"] = primitive.Regex{Pattern: regexp.QuoteMeta(q.Text), Options: "i"}
+	}
+
+	total, err := s.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count chunks: %w", err)
+	}
+
+	filter = mergeFilters(filter, bson.M{"chunk_index": bson.M{"$gt": q.After}})
+	opts := options.Find().
+		SetSort(bson.D{{Key: "chunk_index", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(q.Limit)).
+		SetProjection(chunkProjection(q.Embeddings))
+
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find chunks: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var chunks []models.Chunk
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode chunks: %w", err)
+	}
+	return chunks, total, nil
+}
+
+// GetChunk returns a chunk by ID, or nil if it doesn't exist or only belongs to an upload that hasn't finished
+func (s *MongoStore) GetChunk(ctx context.Context, id primitive.ObjectID, embeddings bool) (*models.Chunk, error) {
+	opts := options.FindOne().SetProjection(chunkProjection(embeddings))
+	var chunk models.Chunk
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&chunk)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find chunk: %w", err)
+	}
+
+	book, err := s.GetBook(ctx, chunk.BookID)
+	if err != nil {
+		return nil, err
+	}
+	if book == nil || chunkVersion(&chunk, book) == 0 {
+		return nil, nil
+	}
+	return &chunk, nil
+}
+
+// the version of a book a chunk is shown in, the current one if the chunk is in it, otherwise its latest
+// 0 if the chunk is only in a version still being stored
+func chunkVersion(chunk *models.Chunk, book *models.Book) int {
+	current := book.CurrentVersion()
+	// chunks stored before versioning belong to version 1
+	if len(chunk.Versions) == 0 {
+		return 1
+	}
+	latest := 0
+	for _, v := range chunk.Versions {
+		if v == current {
+			return current
+		}
+		if v < current && v > latest {
+			latest = v
+		}
+	}
+	return latest
+}
+
+// GetNeighbourChunks returns up to n chunks on each side of a chunk, both in chunk order
+// neighbours come from the version of the book the chunk is shown in, see chunkVersion
+func (s *MongoStore) GetNeighbourChunks(ctx context.Context, chunk *models.Chunk, n int, embeddings bool) (previous, next []models.Chunk, err error) {
+	if n <= 0 {
+		return nil, nil, nil
+	}
+
+	book, err := s.GetBook(ctx, chunk.BookID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if book == nil {
+		return nil, nil, nil
+	}
+	visible, err := s.visibleChunks(ctx, []string{chunk.BookID}, chunkVersion(chunk, book))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	find := func(indexFilter bson.M, direction int) ([]models.Chunk, error) {
+		opts := options.Find().
+			SetSort(bson.D{{Key: "chunk_index", Value: direction}, {Key: "_id", Value: direction}}).
+			SetLimit(int64(n)).
+			SetProjection(chunkProjection(embeddings))
+		filter := mergeFilters(bson.M{"chunk_index": indexFilter}, visible)
+		cursor, err := s.collection.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find neighbouring chunks: %w", err)
+		}
+		defer cursor.Close(ctx)
+
+		var chunks []models.Chunk
+		if err := cursor.All(ctx, &chunks); err != nil {
+			return nil, fmt.Errorf("failed to decode chunks: %w", err)
+		}
+		return chunks, nil
+	}
+
+	previous, err = find(bson.M{"$lt": chunk.ChunkIndex}, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	// fetched nearest first
+	for i, j := 0, len(previous)-1; i < j; i, j = i+1, j-1 {
+		previous[i], previous[j] = previous[j], previous[i]
+	}
+
+	next, err = find(bson.M{"$gt": chunk.ChunkIndex}, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return previous, next, nil
+}
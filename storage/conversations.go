@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// insert a new conversation and set its ID
+func (s *MongoStore) CreateConversation(ctx context.Context, conversation *models.Conversation) error {
+	now := time.Now()
+	conversation.ID = primitive.NewObjectID()
+	conversation.CreatedAt = now
+	conversation.UpdatedAt = now
+	if conversation.Messages == nil {
+		conversation.Messages = []models.Message{}
+	}
+
+	if _, err := s.conversations.InsertOne(ctx, conversation); err != nil {
+		return fmt.Errorf("failed to insert conversation: %w", err)
+	}
+	return nil
+}
+
+// retrieve a conversation with its full message history
+// returns nil if it doesn't exist
+func (s *MongoStore) GetConversation(ctx context.Context, id primitive.ObjectID) (*models.Conversation, error) {
+	var conversation models.Conversation
+	err := s.conversations.FindOne(ctx, bson.M{"_id": id}).Decode(&conversation)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find conversation: %w", err)
+	}
+	return &conversation, nil
+}
+
+// list conversations, most recently updated first, without their messages
+// bookID is optional
+func (s *MongoStore) ListConversations(ctx context.Context, bookID string) ([]models.Conversation, error) {
+	filter := bson.M{}
+	if bookID != "" {
+		filter["book_id"] = bookID
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updated_at", Value: -1}}).
+		SetProjection(bson.M{"messages": 0})
+
+	cursor, err := s.conversations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find conversations: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var conversations []models.Conversation
+	if err := cursor.All(ctx, &conversations); err != nil {
+		return nil, fmt.Errorf("failed to decode conversations: %w", err)
+	}
+	return conversations, nil
+}
+
+// change the title of a conversation, returns false if it doesn't exist
+func (s *MongoStore) RenameConversation(ctx context.Context, id primitive.ObjectID, title string) (bool, error) {
+	update := bson.M{"$set": bson.M{"title": title, "updated_at": time.Now()}}
+	result, err := s.conversations.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to rename conversation: %w", err)
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// append messages to the history of a conversation
+func (s *MongoStore) AppendMessages(ctx context.Context, id primitive.ObjectID, messages ...models.Message) error {
+	update := bson.M{
+		"$push": bson.M{"messages": bson.M{"$each": messages}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	if _, err := s.conversations.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+		return fmt.Errorf("failed to append messages: %w", err)
+	}
+	return nil
+}
+
+// delete a conversation, returns false if it doesn't exist
+func (s *MongoStore) DeleteConversation(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := s.conversations.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete conversation: %w", err)
+	}
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChunkFilterBSON translates a metadata filter into a Mongo filter on the chunks collection
+// returns an error describing the first invalid field
+// the version isn't part of the result, queries add visibleChunks for it
+func ChunkFilterBSON(f *models.ChunkFilter) (bson.M, error) {
+	filter := bson.M{}
+	if f == nil {
+		return filter, nil
+	}
+
+	if author := strings.TrimSpace(f.Author); author != "" {
+		filter["metadata.book_author"] = exactMatch(author)
+	}
+	if title := strings.TrimSpace(f.Title); title != "" {
+		filter["metadata.book_title"] = exactMatch(title)
+	}
+
+	if f.Chapter != nil {
+		chapter, err := rangeFilter("chapter", f.Chapter, 1)
+		if err != nil {
+			return nil, err
+		}
+		filter["metadata.chapter"] = chapter
+	}
+
+	// a chunk matches when it overlaps the range
+	// older chunks all start at 0 and would match ranges they aren't in, so only chunks with real offsets are considered
+	if f.Characters != nil {
+		if _, err := rangeFilter("characters", f.Characters, 0); err != nil {
+			return nil, err
+		}
+		filter["metadata.has_offsets"] = true
+		if f.Characters.Min != nil {
+			filter["metadata.character_end"] = bson.M{"$gte": *f.Characters.Min}
+		}
+		if f.Characters.Max != nil {
+			filter["metadata.character_start"] = bson.M{"$lte": *f.Characters.Max}
+		}
+	}
+
+	if len(f.Tags) > 0 {
+		tags := make([]string, 0, len(f.Tags))
+		for _, tag := range f.Tags {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" {
+				return nil, fmt.Errorf("tags must not be empty")
+			}
+			tags = append(tags, tag)
+		}
+		filter["metadata.tags"] = bson.M{"$all": tags}
+	}
+
+	uploaded := bson.M{}
+	var after, before time.Time
+	if f.UploadedAfter != "" {
+		t, err := parseFilterTime(f.UploadedAfter)
+		if err != nil {
+			return nil, fmt.Errorf("uploaded_after: %w", err)
+		}
+		after = t
+		uploaded["$gte"] = t
+	}
+	if f.UploadedBefore != "" {
+		t, err := parseFilterTime(f.UploadedBefore)
+		if err != nil {
+			return nil, fmt.Errorf("uploaded_before: %w", err)
+		}
+		before = t
+		uploaded["$lt"] = t
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return nil, fmt.Errorf("uploaded_after must be before uploaded_before")
+	}
+	if len(uploaded) > 0 {
+		filter["created_at"] = uploaded
+	}
+
+	if f.Version < 0 {
+		return nil, fmt.Errorf("version must be at least 1")
+	}
+	return filter, nil
+}
+
+// the version of the books a chunk filter selects, the current version when 0
+func filterVersion(f *models.ChunkFilter) int {
+	if f == nil {
+		return 0
+	}
+	return f.Version
+}
+
+// visibleChunks matches the chunks of a version of the given books, or of every book when bookIDs is empty
+// version 0 is each book's current version, read from its record, so a new version becomes visible
+// with the single write that makes it current
+// books still being uploaded, versions still being stored and chunks without a book never match
+func (s *MongoStore) visibleChunks(ctx context.Context, bookIDs []string, version int) (bson.M, error) {
+	filter := bson.M{"status": bson.M{"$ne": models.BookPending}}
+	if len(bookIDs) > 0 {
+		filter["_id"] = bson.M{"$in": bookIDs}
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "version": 1})
+	cursor, err := s.books.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find books: %w", err)
+	}
+	var books []models.Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, fmt.Errorf("failed to decode books: %w", err)
+	}
+
+	byVersion := make(map[int][]string)
+	for _, book := range books {
+		current := book.CurrentVersion()
+		v := version
+		if v == 0 {
+			v = current
+		}
+		if v > current {
+			continue
+		}
+		byVersion[v] = append(byVersion[v], book.ID)
+	}
+
+	versions := make([]int, 0, len(byVersion))
+	for v := range byVersion {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+
+	clauses := make([]bson.M, 0, len(versions))
+	for _, v := range versions {
+		clauses = append(clauses, mergeFilters(bson.M{"book_id": bson.M{"$in": byVersion[v]}}, versionMatch(v)))
+	}
+	switch len(clauses) {
+	case 0:
+		return bson.M{"book_id": bson.M{"$in": []string{}}}, nil
+	case 1:
+		return clauses[0], nil
+	}
+	return bson.M{"$or": clauses}, nil
+}
+
+// match the chunks of one version
+// chunks stored before versioning have no versions and belong to version 1
+func versionMatch(version int) bson.M {
+	if version == 1 {
+		return bson.M{"$or": []bson.M{
+			{"versions": 1},
+			{"versions": bson.M{"$exists": false}},
+		}}
+	}
+	return bson.M{"versions": version}
+}
+
+// validate an inclusive range and translate it to $gte/$lte
+func rangeFilter(field string, r *models.IntRange, lowest int) (bson.M, error) {
+	if r.Min == nil && r.Max == nil {
+		return nil, fmt.Errorf("%s needs a min or a max", field)
+	}
+	if r.Min != nil && *r.Min < lowest {
+		return nil, fmt.Errorf("%s.min must be at least %d", field, lowest)
+	}
+	if r.Max != nil && *r.Max < lowest {
+		return nil, fmt.Errorf("%s.max must be at least %d", field, lowest)
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return nil, fmt.Errorf("%s.min must not be greater than %s.max", field, field)
+	}
+
+	filter := bson.M{}
+	if r.Min != nil {
+		filter["$gte"] = *r.Min
+	}
+	if r.Max != nil {
+		filter["$lte"] = *r.Max
+	}
+	return filter, nil
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", value)
+}
+
+// case-insensitive exact match
+func exactMatch(value string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+}
+
+// require every non-empty filter to match
+func mergeFilters(filters ...bson.M) bson.M {
+	var parts []interface{}
+	for _, filter := range filters {
+		if len(filter) > 0 {
+			parts = append(parts, filter)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return parts[0].(bson.M)
+	}
+	return bson.M{"$and": parts}
+}
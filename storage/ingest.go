@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// uploads are staged rather than run in a transaction, which needs a replica set
+// 1. The book is recorded as pending
+// 2. Its chunks are inserted in as many batches as needed, queries skip them while the book is pending
+// 3. Once every write succeeded the book is marked ready, which makes the chunks visible in a single write
+// an upload that fails is rolled back, one that never finishes (or whose rollback fails) is cleaned up by CleanupPending
+
+// BeginBook records a book whose chunks are about to be inserted
+func (s *MongoStore) BeginBook(ctx context.Context, book *models.Book) error {
+	book.Status = models.BookPending
+	book.UpdatedAt = time.Now()
+	return s.InsertBook(ctx, book)
+}
+
+// TouchBook records that an upload is still making progress, so the pending cleanup leaves it alone
+func (s *MongoStore) TouchBook(ctx context.Context, bookID string) error {
+	if _, err := s.books.UpdateOne(ctx, bson.M{"_id": bookID}, bson.M{"$set": bson.M{"updated_at": time.Now()}}); err != nil {
+		return fmt.Errorf("failed to update book: %w", err)
+	}
+	return nil
+}
+
+// PublishBook marks a pending book ready, making its chunks visible
+// the totals known only once every chunk is stored are saved from book
+func (s *MongoStore) PublishBook(ctx context.Context, book *models.Book) error {
+	update := bson.M{"$set": bson.M{
+		"status":        models.BookReady,
+		"total_chunks":  book.TotalChunks,
+		"total_chars":   book.TotalChars,
+		"chapters":      book.Chapters,
+		"embedding_dim": book.EmbeddingDim,
+		"versions":      book.Versions,
+		"updated_at":    time.Now(),
+	}}
+	result, err := s.books.UpdateOne(ctx, bson.M{"_id": book.ID, "status": models.BookPending}, update)
+	if err != nil {
+		return fmt.Errorf("failed to mark book ready: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("book %s is no longer pending", book.ID)
+	}
+	book.Status = models.BookReady
+	return nil
+}
+
+// AbortBook removes everything written by an upload that failed
+// chunks go first, so a failure part way leaves a pending book for the startup cleanup
+func (s *MongoStore) AbortBook(ctx context.Context, bookID string) error {
+	if err := s.DeleteChunksByBookID(ctx, bookID); err != nil {
+		return err
+	}
+	if _, err := s.books.DeleteOne(ctx, bson.M{"_id": bookID}); err != nil {
+		return fmt.Errorf("failed to delete pending book: %w", err)
+	}
+	return nil
+}
+
+// CleanupPending removes uploads that didn't finish and were last touched before the cutoff, and releases stalled reindexes
+// returns the number of books deleted and versions rolled back
+func (s *MongoStore) CleanupPending(ctx context.Context, cutoff time.Time) (int, int, error) {
+	stale := bson.M{"updated_at": bson.M{"$lt": cutoff}}
+
+	var pendingBooks []models.Book
+	cursor, err := s.books.Find(ctx, mergeFilters(bson.M{"status": models.BookPending}, stale))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find pending books: %w", err)
+	}
+	if err := cursor.All(ctx, &pendingBooks); err != nil {
+		return 0, 0, fmt.Errorf("failed to decode pending books: %w", err)
+	}
+	for _, book := range pendingBooks {
+		if err := s.AbortBook(ctx, book.ID); err != nil {
+			return 0, 0, err
+		}
+		log.Printf("Removed unfinished upload of %s (%s)", book.ID, book.Title)
+	}
+
+	var pendingVersions []models.Book
+	cursor, err = s.books.Find(ctx, mergeFilters(bson.M{"pending_version": bson.M{"$gt": 0}}, stale))
+	if err != nil {
+		return len(pendingBooks), 0, fmt.Errorf("failed to find pending versions: %w", err)
+	}
+	if err := cursor.All(ctx, &pendingVersions); err != nil {
+		return len(pendingBooks), 0, fmt.Errorf("failed to decode pending versions: %w", err)
+	}
+	for _, book := range pendingVersions {
+		if err := s.AbortVersion(ctx, book.ID, book.PendingVersion); err != nil {
+			return len(pendingBooks), 0, err
+		}
+		log.Printf("Rolled back unfinished version %d of %s (%s)", book.PendingVersion, book.ID, book.Title)
+	}
+
+	if _, err := s.cleanupReindexClaims(ctx, cutoff); err != nil {
+		return len(pendingBooks), len(pendingVersions), err
+	}
+
+	// chunks of uploads whose book was deleted while they were being inserted
+	orphans, err := s.orphanedBookIDs(ctx, cutoff)
+	if err != nil {
+		return len(pendingBooks), len(pendingVersions), err
+	}
+	if len(orphans) > 0 {
+		result, err := s.collection.DeleteMany(ctx, bson.M{"book_id": bson.M{"$in": orphans}})
+		if err != nil {
+			return len(pendingBooks), len(pendingVersions), fmt.Errorf("failed to delete orphaned chunks: %w", err)
+		}
+		log.Printf("Removed %d chunks of unfinished uploads", result.DeletedCount)
+	}
+
+	return len(pendingBooks), len(pendingVersions), nil
+}
+
+// books with chunks written before the cutoff but no book record
+// chunks stored before books were recorded have no versions and are left to BackfillBooks
+func (s *MongoStore) orphanedBookIDs(ctx context.Context, cutoff time.Time) ([]string, error) {
+	filter := bson.M{"versions": bson.M{"$exists": true}, "created_at": bson.M{"$lt": cutoff}}
+	distinct, err := s.collection.Distinct(ctx, "book_id", filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list books of chunks: %w", err)
+	}
+	bookIDs := make([]string, 0, len(distinct))
+	for _, id := range distinct {
+		if str, ok := id.(string); ok {
+			bookIDs = append(bookIDs, str)
+		}
+	}
+	if len(bookIDs) == 0 {
+		return nil, nil
+	}
+
+	known, err := s.books.Distinct(ctx, "_id", bson.M{"_id": bson.M{"$in": bookIDs}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find books: %w", err)
+	}
+	exists := make(map[string]bool, len(known))
+	for _, id := range known {
+		if str, ok := id.(string); ok {
+			exists[str] = true
+		}
+	}
+
+	var orphans []string
+	for _, id := range bookIDs {
+		if !exists[id] {
+			orphans = append(orphans, id)
+		}
+	}
+	return orphans, nil
+}
@@ -17,10 +17,13 @@ import (
 
 // MongoStore handles MongoDB operations
 type MongoStore struct {
-	client     *mongo.Client
-	database   *mongo.Database
-	collection *mongo.Collection
-	config     *config.Config
+	client        *mongo.Client
+	database      *mongo.Database
+	collection    *mongo.Collection
+	conversations *mongo.Collection
+	summaries     *mongo.Collection
+	books         *mongo.Collection
+	config        *config.Config
 }
 
 func NewMongoStore(cfg *config.Config) (*MongoStore, error) {
@@ -42,10 +45,13 @@ func NewMongoStore(cfg *config.Config) (*MongoStore, error) {
 	log.Printf("Connected to MongoDB: %s/%s", cfg.MongoDatabase, cfg.MongoCollection)
 
 	return &MongoStore{
-		client:     client,
-		database:   database,
-		collection: collection,
-		config:     cfg,
+		client:        client,
+		database:      database,
+		collection:    collection,
+		conversations: database.Collection(cfg.MongoConversationsCollection),
+		summaries:     database.Collection(cfg.MongoSummariesCollection),
+		books:         database.Collection(cfg.MongoBooksCollection),
+		config:        cfg,
 	}, nil
 }
 
@@ -219,38 +225,87 @@ func (s *MongoStore) VectorSearch(ctx context.Context, queryEmbedding []float32,
 
 // perform vector search using cosine similarity
 func (s *MongoStore) SimpleVectorSearch(ctx context.Context, queryEmbedding []float32, limit int, bookID string) ([]models.SearchResult, error) {
+	return s.FilteredVectorSearch(ctx, queryEmbedding, limit, bookID, nil, nil)
+}
+
+// perform vector search over the chunks matching a metadata filter
+// the filter runs in MongoDB, so only matching chunks are loaded and scored
+// chunks are scored with the embeddings of the snapshot the query was embedded against, a nil snapshot is taken before the fetch
+func (s *MongoStore) FilteredVectorSearch(ctx context.Context, queryEmbedding []float32, limit int, bookID string, chunkFilter *models.ChunkFilter, snapshot *EmbeddingSnapshot) ([]models.SearchResult, error) {
+	results, _, err := s.FilteredVectorSearchStats(ctx, queryEmbedding, limit, bookID, chunkFilter, snapshot)
+	return results, err
+}
+
+// SearchStats describes the work done by a vector search
+type SearchStats struct {
+	Scanned   int // chunks matching the filter, loaded for scoring
+	Skipped   int // chunks whose embedding dimension or model doesn't match the query's
+	FetchTime time.Duration
+	ScoreTime time.Duration // scoring and sorting
+}
+
+// FilteredVectorSearchStats is FilteredVectorSearch that also reports how much it scanned and where the time went
+func (s *MongoStore) FilteredVectorSearchStats(ctx context.Context, queryEmbedding []float32, limit int, bookID string, chunkFilter *models.ChunkFilter, snapshot *EmbeddingSnapshot) ([]models.SearchResult, SearchStats, error) {
+	var stats SearchStats
+
 	// build filter
-	filter := bson.M{}
+	filter, err := ChunkFilterBSON(chunkFilter)
+	if err != nil {
+		return nil, stats, err
+	}
+	var bookIDs []string
 	if bookID != "" {
-		filter["book_id"] = bookID
+		bookIDs = []string{bookID}
+	}
+	visible, err := s.visibleChunks(ctx, bookIDs, filterVersion(chunkFilter))
+	if err != nil {
+		return nil, stats, err
+	}
+	filter = mergeFilters(filter, visible)
+	if snapshot == nil {
+		if snapshot, err = s.SnapshotEmbeddings(ctx, bookIDs); err != nil {
+			return nil, stats, err
+		}
 	}
 
 	// fetch all chunks (or filtered by bookID)
+	fetchStart := time.Now()
 	cursor, err := s.collection.Find(ctx, filter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch chunks: %w", err)
+		return nil, stats, fmt.Errorf("failed to fetch chunks: %w", err)
 	}
 	defer cursor.Close(ctx)
 
 	var chunks []models.Chunk
 	if err := cursor.All(ctx, &chunks); err != nil {
-		return nil, fmt.Errorf("failed to decode chunks: %w", err)
+		return nil, stats, fmt.Errorf("failed to decode chunks: %w", err)
 	}
+	stats.FetchTime = time.Since(fetchStart)
+	stats.Scanned = len(chunks)
+	scoreStart := time.Now()
 
 	// calculate cosine similarity for each chunk
 	results := make([]models.SearchResult, 0, len(chunks))
+	skipped := 0
 	for _, chunk := range chunks {
-		if len(chunk.Embedding) != len(queryEmbedding) {
+		embedding := snapshot.liveEmbedding(&chunk)
+		if len(embedding) != len(queryEmbedding) {
+			skipped++
 			continue
 		}
 
-		score := cosineSimilarity(queryEmbedding, chunk.Embedding)
+		score := cosineSimilarity(queryEmbedding, embedding)
+		chunk.Embedding, chunk.EmbeddingNext = embedding, nil
 		results = append(results, models.SearchResult{
 			Chunk: chunk,
 			Score: float64(score),
 		})
 	}
 
+	if skipped > 0 {
+		log.Printf("Warning: skipped %d chunks with embedding dimension != %d or another embedding model (re-index with the current embedding model)", skipped, len(queryEmbedding))
+	}
+
 	// sort by score (descending)
 	// simple bubble sort for small datasets
 	for i := 0; i < len(results)-1; i++ {
@@ -266,7 +321,9 @@ func (s *MongoStore) SimpleVectorSearch(ctx context.Context, queryEmbedding []fl
 		results = results[:limit]
 	}
 
-	return results, nil
+	stats.Skipped = skipped
+	stats.ScoreTime = time.Since(scoreStart)
+	return results, stats, nil
 }
 
 // calculate cosine similarity between two vectors
@@ -303,10 +360,14 @@ func sqrt(x float32) float32 {
 	return z
 }
 
-// retrieve all chunks for a specific book
+// retrieve all chunks of the current version of a book in chunk order
 func (s *MongoStore) GetChunksByBookID(ctx context.Context, bookID string) ([]models.Chunk, error) {
-	filter := bson.M{"book_id": bookID}
-	cursor, err := s.collection.Find(ctx, filter)
+	filter, err := s.visibleChunks(ctx, []string{bookID}, 0)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "chunk_index", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.collection.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find chunks: %w", err)
 	}
@@ -320,6 +381,87 @@ func (s *MongoStore) GetChunksByBookID(ctx context.Context, bookID string) ([]mo
 	return chunks, nil
 }
 
+// return the embedding models and dimensions used by the stored chunks
+// chunks written before embedding_model was recorded are reported with an empty model
+func (s *MongoStore) GetEmbeddingModels(ctx context.Context) ([]models.EmbeddingInfo, error) {
+	return s.embeddingInfo(ctx, bson.M{})
+}
+
+func (s *MongoStore) embeddingInfo(ctx context.Context, filter bson.M) ([]models.EmbeddingInfo, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{
+					{Key: "model", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$embedding_model", ""}}}},
+					{Key: "dim", Value: bson.D{{Key: "$size", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$embedding", bson.A{}}}}}}},
+				}},
+				{Key: "chunks", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}},
+		},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "chunks", Value: -1}}}},
+		bson.D{
+			{Key: "$project", Value: bson.D{
+				{Key: "_id", Value: 0},
+				{Key: "model", Value: "$_id.model"},
+				{Key: "dim", Value: "$_id.dim"},
+				{Key: "chunks", Value: 1},
+			}},
+		},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate embedding models: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var infos []models.EmbeddingInfo
+	if err := cursor.All(ctx, &infos); err != nil {
+		return nil, fmt.Errorf("failed to decode embedding models: %w", err)
+	}
+
+	return infos, nil
+}
+
+// iterate over the chunks of a book in chunk order without loading them all into memory
+// embeddings are not loaded
+func (s *MongoStore) StreamChunks(ctx context.Context, bookID string, fn func(models.Chunk) error) error {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "chunk_index", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"embedding": 0, "embedding_next": 0})
+
+	cursor, err := s.collection.Find(ctx, bson.M{"book_id": bookID}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to find chunks: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var chunk models.Chunk
+		if err := cursor.Decode(&chunk); err != nil {
+			return fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("cursor error: %w", err)
+	}
+	return nil
+}
+
+// return the number of chunks stored for a book
+func (s *MongoStore) CountBookChunks(ctx context.Context, bookID string) (int64, error) {
+	count, err := s.collection.CountDocuments(ctx, bson.M{"book_id": bookID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count chunks: %w", err)
+	}
+	return count, nil
+}
+
 // delete all chunks for a specific book
 func (s *MongoStore) DeleteChunksByBookID(ctx context.Context, bookID string) error {
 	filter := bson.M{"book_id": bookID}
@@ -356,86 +498,6 @@ func (s *MongoStore) GetUniqueBookIDs(ctx context.Context) ([]string, error) {
 	return bookIDs, nil
 }
 
-// GetBooks retrieves a list of unique books
-func (s *MongoStore) GetBooks(ctx context.Context) ([]models.Book, error) {
-	pipeline := mongo.Pipeline{
-		bson.D{
-			{Key: "$group", Value: bson.D{
-				{Key: "_id", Value: "$book_id"},
-				{Key: "title", Value: bson.D{{Key: "$first", Value: "$metadata.book_title"}}},
-				{Key: "author", Value: bson.D{{Key: "$first", Value: "$metadata.book_author"}}},
-				{Key: "uploaded_at", Value: bson.D{{Key: "$min", Value: "$created_at"}}},
-			}},
-		},
-		bson.D{
-			{Key: "$addFields", Value: bson.D{
-				{Key: "id", Value: "$_id"},
-			}},
-		},
-		bson.D{
-			{Key: "$project", Value: bson.D{
-				{Key: "_id", Value: "$_id"},
-				{Key: "id", Value: 1},
-				{Key: "title", Value: 1},
-				{Key: "author", Value: 1},
-				{Key: "uploaded_at", Value: 1},
-			}},
-		},
-	}
-
-	cursor, err := s.collection.Aggregate(ctx, pipeline)
-	if err != nil {
-		return nil, fmt.Errorf("failed to aggregate books: %w", err)
-	}
-	defer cursor.Close(ctx)
-
-	var results []bson.M
-	if err := cursor.All(ctx, &results); err != nil {
-		return nil, fmt.Errorf("failed to decode books: %w", err)
-	}
-
-	books := make([]models.Book, 0, len(results))
-	for _, result := range results {
-		book := models.Book{
-			Title:      getString(result, "title"),
-			Author:     getString(result, "author"),
-			UploadedAt: getTime(result, "uploaded_at"),
-		}
-
-		// Get id from either "id" field or "_id" field
-		if id, ok := result["id"].(string); ok && id != "" {
-			book.ID = id
-		} else if id, ok := result["_id"].(string); ok && id != "" {
-			book.ID = id
-		}
-
-		books = append(books, book)
-	}
-
-	return books, nil
-}
-
-func getString(m bson.M, key string) string {
-	if val, ok := m[key]; ok {
-		if str, ok := val.(string); ok {
-			return str
-		}
-	}
-	return ""
-}
-
-func getTime(m bson.M, key string) time.Time {
-	if val, ok := m[key]; ok {
-		if t, ok := val.(primitive.DateTime); ok {
-			return t.Time()
-		}
-		if t, ok := val.(time.Time); ok {
-			return t
-		}
-	}
-	return time.Time{}
-}
-
 // helper to generate ObjectID
 func GenerateObjectID() primitive.ObjectID {
 	return primitive.NewObjectID()
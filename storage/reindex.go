@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// a reindex writes the new vectors to the shadow field embedding_next and swaps them in without a transaction
+// 1. The book is claimed, so no version is uploaded while its chunks are re-embedded
+// 2. Every chunk of the book gets its new vector in embedding_next, queries keep reading embedding
+// 3. The book is switched to read embedding_next along with its new model, in one write
+// 4. embedding_next is copied to embedding, unseen by queries, then the book is switched back and the shadow dropped
+// a swap that stops after 3 leaves the book reading a complete shadow field, and is finished by the next claim or CleanupPending
+// queries read the book's model and field once, in an EmbeddingSnapshot, and skip chunks a later step has moved on
+
+// ClaimReindex reserves a book for a reindex under claim
+// returns the book, nil if it doesn't exist or hasn't finished uploading, or ErrBookBusy if a version upload or another reindex holds it
+func (s *MongoStore) ClaimReindex(ctx context.Context, bookID, claim string) (*models.Book, error) {
+	filter := bson.M{
+		"_id":             bookID,
+		"status":          bson.M{"$ne": models.BookPending},
+		"pending_version": bson.M{"$exists": false},
+		"reindex_claim":   bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"reindex_claim": claim, "updated_at": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var book models.Book
+	err := s.books.FindOneAndUpdate(ctx, filter, update, opts).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		existing, err := s.GetBook(ctx, bookID)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, nil
+		}
+		return nil, ErrBookBusy
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim book for reindex: %w", err)
+	}
+
+	if book.ShadowActive {
+		if err := s.finishShadowSwap(ctx, bookID); err != nil {
+			return &book, err
+		}
+	} else if err := s.ClearShadowEmbeddings(ctx, bookID); err != nil {
+		return &book, err
+	}
+	return &book, nil
+}
+
+// ReleaseReindex ends a reindex of a book
+// a swap left part way is finished, shadow embeddings that were never swapped in are dropped
+func (s *MongoStore) ReleaseReindex(ctx context.Context, bookID, claim string) error {
+	var book models.Book
+	err := s.books.FindOne(ctx, bson.M{"_id": bookID, "reindex_claim": claim}).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find book: %w", err)
+	}
+
+	if book.ShadowActive {
+		if err := s.finishShadowSwap(ctx, bookID); err != nil {
+			return err
+		}
+	} else if err := s.ClearShadowEmbeddings(ctx, bookID); err != nil {
+		return err
+	}
+
+	if _, err := s.books.UpdateOne(ctx, bson.M{"_id": bookID, "reindex_claim": claim}, bson.M{"$unset": bson.M{"reindex_claim": ""}}); err != nil {
+		return fmt.Errorf("failed to release book: %w", err)
+	}
+	return nil
+}
+
+// write re-embedded vectors to the shadow field, leaving the live embedding untouched
+// embeddings are keyed by chunk ID
+func (s *MongoStore) SetShadowEmbeddings(ctx context.Context, embeddings map[primitive.ObjectID][]float32) error {
+	if len(embeddings) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(embeddings))
+	for id, embedding := range embeddings {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$set": bson.M{"embedding_next": embedding}}))
+	}
+
+	if _, err := s.collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+		return fmt.Errorf("failed to write shadow embeddings: %w", err)
+	}
+	return nil
+}
+
+// SwapShadowEmbeddings makes the shadow embeddings of a claimed book live
+// queries switch from the old model to the new one with a single write to the book, never seeing a mix of the two
+// returns the number of chunks swapped
+func (s *MongoStore) SwapShadowEmbeddings(ctx context.Context, bookID, claim, model string, dim int) (int64, error) {
+	missing, err := s.collection.CountDocuments(ctx, bson.M{"book_id": bookID, "embedding_next": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count chunks: %w", err)
+	}
+	if missing > 0 {
+		return 0, fmt.Errorf("%d chunks of book %s have no shadow embedding", missing, bookID)
+	}
+
+	activate := bson.M{"$set": bson.M{
+		"shadow_active":   true,
+		"embedding_model": model,
+		"embedding_dim":   dim,
+		"updated_at":      time.Now(),
+	}}
+	result, err := s.books.UpdateOne(ctx, bson.M{"_id": bookID, "reindex_claim": claim}, activate)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update book embedding model: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return 0, fmt.Errorf("book %s is no longer claimed for reindex", bookID)
+	}
+
+	count, err := s.CountBookChunks(ctx, bookID)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.finishShadowSwap(ctx, bookID); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// copy the shadow embeddings of a book reading them to the live field, then switch the book back to it
+func (s *MongoStore) finishShadowSwap(ctx context.Context, bookID string) error {
+	var book models.Book
+	if err := s.books.FindOne(ctx, bson.M{"_id": bookID}).Decode(&book); err != nil {
+		return fmt.Errorf("failed to find book: %w", err)
+	}
+
+	filter := bson.M{
+		"book_id":        bookID,
+		"embedding_next": bson.M{"$exists": true},
+	}
+	copyShadow := mongo.Pipeline{
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "embedding", Value: "$embedding_next"},
+			{Key: "embedding_model", Value: book.EmbeddingModel},
+			{Key: "embedding_dim", Value: book.EmbeddingDim},
+		}}},
+	}
+	if _, err := s.collection.UpdateMany(ctx, filter, copyShadow); err != nil {
+		return fmt.Errorf("failed to swap embeddings: %w", err)
+	}
+
+	if _, err := s.books.UpdateOne(ctx, bson.M{"_id": bookID}, bson.M{"$unset": bson.M{"shadow_active": ""}}); err != nil {
+		return fmt.Errorf("failed to switch book to swapped embeddings: %w", err)
+	}
+	return s.ClearShadowEmbeddings(ctx, bookID)
+}
+
+// drop the shadow embeddings of a book that isn't reading them
+func (s *MongoStore) ClearShadowEmbeddings(ctx context.Context, bookID string) error {
+	filter := bson.M{
+		"book_id":        bookID,
+		"embedding_next": bson.M{"$exists": true},
+	}
+	if _, err := s.collection.UpdateMany(ctx, filter, bson.M{"$unset": bson.M{"embedding_next": ""}}); err != nil {
+		return fmt.Errorf("failed to clear shadow embeddings: %w", err)
+	}
+	return nil
+}
+
+// EmbeddingSnapshot is the embedding model of a set of books and the field their queries read, taken at one moment
+// a search embeds its query and scores chunks against the same snapshot, so a swap landing during the search can't mix models
+type EmbeddingSnapshot struct {
+	books map[string]BookEmbedding
+}
+
+// BookEmbedding is what queries of a book read at the time of a snapshot
+type BookEmbedding struct {
+	Model  string // empty for books recorded without one
+	Dim    int
+	Shadow bool // reading embedding_next
+}
+
+// SnapshotEmbeddings reads the embedding model and live field of bookIDs, or of every book when it is empty
+// listed books recorded without a model fall back to the majority of their chunks
+func (s *MongoStore) SnapshotEmbeddings(ctx context.Context, bookIDs []string) (*EmbeddingSnapshot, error) {
+	filter := bson.M{}
+	if len(bookIDs) > 0 {
+		filter["_id"] = bson.M{"$in": bookIDs}
+	}
+	opts := options.Find().SetProjection(bson.M{"embedding_model": 1, "embedding_dim": 1, "shadow_active": 1})
+	cursor, err := s.books.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find books: %w", err)
+	}
+	var books []models.Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, fmt.Errorf("failed to decode books: %w", err)
+	}
+
+	snapshot := &EmbeddingSnapshot{books: make(map[string]BookEmbedding, len(books))}
+	for _, book := range books {
+		snapshot.books[book.ID] = BookEmbedding{Model: book.EmbeddingModel, Dim: book.EmbeddingDim, Shadow: book.ShadowActive}
+	}
+
+	for _, bookID := range bookIDs {
+		if book := snapshot.books[bookID]; book.Model != "" && book.Dim > 0 {
+			continue
+		}
+		infos, err := s.embeddingInfo(ctx, bson.M{"book_id": bookID})
+		if err != nil {
+			return nil, err
+		}
+		// results are sorted by chunk count, the majority model wins
+		if len(infos) > 0 {
+			book := snapshot.books[bookID]
+			book.Model, book.Dim = infos[0].Model, infos[0].Dim
+			snapshot.books[bookID] = book
+		}
+	}
+	return snapshot, nil
+}
+
+// Book returns what queries of a book read, the zero value for books not in the snapshot
+func (snap *EmbeddingSnapshot) Book(bookID string) BookEmbedding {
+	return snap.books[bookID]
+}
+
+// the embedding a chunk is scored with, nil when the book has moved on to another model since the snapshot
+func (snap *EmbeddingSnapshot) liveEmbedding(chunk *models.Chunk) []float32 {
+	book := snap.books[chunk.BookID]
+	if book.Shadow {
+		// a swap that finished since has already copied the shadow to embedding
+		if len(chunk.EmbeddingNext) > 0 {
+			return chunk.EmbeddingNext
+		}
+		return chunk.Embedding
+	}
+	// a swap that started since may have copied the new model's vectors to embedding already
+	if book.Model != "" && chunk.EmbeddingModel != "" && chunk.EmbeddingModel != book.Model {
+		return nil
+	}
+	return chunk.Embedding
+}
+
+// release reindex claims of jobs that stopped making progress before the cutoff, returns how many were released
+func (s *MongoStore) cleanupReindexClaims(ctx context.Context, cutoff time.Time) (int, error) {
+	filter := bson.M{"reindex_claim": bson.M{"$exists": true}, "updated_at": bson.M{"$lt": cutoff}}
+	cursor, err := s.books.Find(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find reindexed books: %w", err)
+	}
+	var books []models.Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return 0, fmt.Errorf("failed to decode reindexed books: %w", err)
+	}
+	for _, book := range books {
+		if err := s.ReleaseReindex(ctx, book.ID, book.ReindexClaim); err != nil {
+			return 0, err
+		}
+		log.Printf("Released unfinished reindex of %s (%s)", book.ID, book.Title)
+	}
+	return len(books), nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// LibraryFilter selects the books a search covers, empty fields don't restrict it
+type LibraryFilter struct {
+	BookIDs []string
+	Tags    []string // books with any of these tags
+	Author  string   // case-insensitive exact match
+	// only search chunks whose metadata matches
+	Chunks *models.ChunkFilter
+}
+
+// build the chunk filter for a library search
+func (s *MongoStore) libraryFilter(ctx context.Context, f LibraryFilter) (bson.M, error) {
+	filter := bson.M{}
+	if len(f.BookIDs) > 0 {
+		filter["book_id"] = bson.M{"$in": f.BookIDs}
+	}
+	if len(f.Tags) > 0 {
+		filter["metadata.tags"] = bson.M{"$in": f.Tags}
+	}
+	if f.Author != "" {
+		filter["metadata.book_author"] = exactMatch(f.Author)
+	}
+
+	chunkFilter, err := ChunkFilterBSON(f.Chunks)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := s.visibleChunks(ctx, f.BookIDs, filterVersion(f.Chunks))
+	if err != nil {
+		return nil, err
+	}
+	return mergeFilters(filter, chunkFilter, visible), nil
+}
+
+// FindBookIDs lists the books matching a library filter
+func (s *MongoStore) FindBookIDs(ctx context.Context, filter LibraryFilter) ([]string, error) {
+	query, err := s.libraryFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	distinct, err := s.collection.Distinct(ctx, "book_id", query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find books: %w", err)
+	}
+
+	bookIDs := make([]string, 0, len(distinct))
+	for _, id := range distinct {
+		if str, ok := id.(string); ok {
+			bookIDs = append(bookIDs, str)
+		}
+	}
+	sort.Strings(bookIDs)
+	return bookIDs, nil
+}
+
+// SearchBooks scores every chunk of the given books matching the chunk filter against the query embedding
+// returns each book's top chunks along with the mean and spread of all its scores
+// chunks are scored with the embeddings of the snapshot the query was embedded against
+func (s *MongoStore) SearchBooks(ctx context.Context, queryEmbedding []float32, limit int, bookIDs []string, chunkFilter *models.ChunkFilter, snapshot *EmbeddingSnapshot) ([]models.BookSearchResult, error) {
+	filter, err := ChunkFilterBSON(chunkFilter)
+	if err != nil {
+		return nil, err
+	}
+	if len(bookIDs) == 0 {
+		return []models.BookSearchResult{}, nil
+	}
+	visible, err := s.visibleChunks(ctx, bookIDs, filterVersion(chunkFilter))
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.collection.Find(ctx, mergeFilters(filter, visible))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunks: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	type bookStats struct {
+		results []models.SearchResult
+		sum     float64
+		sumSq   float64
+	}
+	books := make(map[string]*bookStats)
+	skipped := 0
+
+	for cursor.Next(ctx) {
+		var chunk models.Chunk
+		if err := cursor.Decode(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		embedding := snapshot.liveEmbedding(&chunk)
+		if len(embedding) != len(queryEmbedding) {
+			skipped++
+			continue
+		}
+
+		score := float64(cosineSimilarity(queryEmbedding, embedding))
+		stats, ok := books[chunk.BookID]
+		if !ok {
+			stats = &bookStats{}
+			books[chunk.BookID] = stats
+		}
+		stats.sum += score
+		stats.sumSq += score * score
+
+		// drop the embedding, only the best chunks are kept and returned
+		chunk.Embedding, chunk.EmbeddingNext = nil, nil
+		stats.results = append(stats.results, models.SearchResult{Chunk: chunk, Score: score})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %w", err)
+	}
+
+	if skipped > 0 {
+		log.Printf("Warning: skipped %d chunks with embedding dimension != %d or another embedding model (re-index with the current embedding model)", skipped, len(queryEmbedding))
+	}
+
+	results := make([]models.BookSearchResult, 0, len(books))
+	for bookID, stats := range books {
+		n := float64(len(stats.results))
+		mean := stats.sum / n
+		variance := stats.sumSq/n - mean*mean
+
+		sort.Slice(stats.results, func(i, j int) bool {
+			return stats.results[i].Score > stats.results[j].Score
+		})
+		top := stats.results
+		if len(top) > limit {
+			top = top[:limit]
+		}
+
+		results = append(results, models.BookSearchResult{
+			BookID:  bookID,
+			Results: top,
+			Scanned: len(stats.results),
+			Mean:    mean,
+			StdDev:  math.Sqrt(math.Max(variance, 0)),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].BookID < results[j].BookID
+	})
+
+	return results, nil
+}
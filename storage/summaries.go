@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sections are identified by book, level, chunk range, target length and model
+func summaryKey(summary *models.Summary) bson.M {
+	return bson.M{
+		"book_id":      summary.BookID,
+		"level":        summary.Level,
+		"first_chunk":  summary.FirstChunk,
+		"last_chunk":   summary.LastChunk,
+		"target_words": summary.TargetWords,
+		"model":        summary.Model,
+	}
+}
+
+// look up a cached summary matching the key fields of summary
+// returns nil if there is none
+func (s *MongoStore) GetSummary(ctx context.Context, key *models.Summary) (*models.Summary, error) {
+	var summary models.Summary
+	err := s.summaries.FindOne(ctx, summaryKey(key)).Decode(&summary)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find summary: %w", err)
+	}
+	return &summary, nil
+}
+
+// store a summary, replacing any cached one with the same key
+func (s *MongoStore) SaveSummary(ctx context.Context, summary *models.Summary) error {
+	summary.CreatedAt = time.Now()
+	update := bson.M{"$set": bson.M{"text": summary.Text, "created_at": summary.CreatedAt}}
+	opts := options.Update().SetUpsert(true)
+	if _, err := s.summaries.UpdateOne(ctx, summaryKey(summary), update, opts); err != nil {
+		return fmt.Errorf("failed to save summary: %w", err)
+	}
+	return nil
+}
+
+// remove every cached summary of a book
+func (s *MongoStore) DeleteSummaries(ctx context.Context, bookID string) error {
+	if _, err := s.summaries.DeleteMany(ctx, bson.M{"book_id": bookID}); err != nil {
+		return fmt.Errorf("failed to delete summaries: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blavejr/bowattAI/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrBookBusy is returned when another new version of the book is still being stored
+var ErrBookBusy = errors.New("another version of the book is being stored")
+
+// new versions are staged like uploads
+// 1. ClaimVersion reserves the next version number on the book, one upload at a time
+// 2. Its chunks are inserted and unchanged chunks of the current version are tagged with it, queries don't see it yet
+// 3. PublishVersion makes it current with a single write to the book, queries resolve the current version through the book
+// a version that fails is removed by AbortVersion, one that never finishes is cleaned up by CleanupPending
+
+// ClaimVersion reserves the next version of a book for an upload
+// returns the book with PendingVersion set, nil if it doesn't exist, or ErrBookBusy if another upload or a reindex holds it
+func (s *MongoStore) ClaimVersion(ctx context.Context, bookID string) (*models.Book, error) {
+	filter := bson.M{
+		"_id":             bookID,
+		"status":          bson.M{"$ne": models.BookPending},
+		"pending_version": bson.M{"$exists": false},
+		"reindex_claim":   bson.M{"$exists": false},
+	}
+	// books recorded before versioning have no version and are at version 1
+	claim := mongo.Pipeline{bson.D{{Key: "$set", Value: bson.M{
+		"pending_version": bson.M{"$add": bson.A{bson.M{"$max": bson.A{bson.M{"$ifNull": bson.A{"$version", 1}}, 1}}, 1}},
+		"updated_at":      "$$NOW",
+	}}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var book models.Book
+	err := s.books.FindOneAndUpdate(ctx, filter, claim, opts).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		existing, err := s.GetBook(ctx, bookID)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, nil
+		}
+		return nil, ErrBookBusy
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim version: %w", err)
+	}
+
+	// chunks stored before versioning belong to version 1
+	legacy := bson.M{"book_id": bookID, "versions": bson.M{"$exists": false}}
+	if _, err := s.collection.UpdateMany(ctx, legacy, bson.M{"$set": bson.M{"versions": []int{1}}}); err != nil {
+		return &book, fmt.Errorf("failed to record chunk versions: %w", err)
+	}
+	return &book, nil
+}
+
+// KeepChunks adds chunks of the current version to a pending version
+func (s *MongoStore) KeepChunks(ctx context.Context, ids []primitive.ObjectID, version int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	update := bson.M{"$addToSet": bson.M{"versions": version}}
+	if _, err := s.collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, update); err != nil {
+		return fmt.Errorf("failed to keep unchanged chunks: %w", err)
+	}
+	return nil
+}
+
+// PublishVersion makes the claimed version of a book current
+// chunks of the previous version that weren't kept stay queryable by version
+// returns ErrDuplicateBook if another book already has the new text
+func (s *MongoStore) PublishVersion(ctx context.Context, book *models.Book, version models.BookVersion) error {
+	// books recorded before versioning have no entry for their first version
+	added := []models.BookVersion{version}
+	if len(book.Versions) == 0 {
+		first := models.BookVersion{
+			Version:     book.CurrentVersion(),
+			ContentHash: book.ContentHash,
+			TotalChunks: book.TotalChunks,
+			TotalChars:  book.TotalChars,
+			Chapters:    book.Chapters,
+			UploadedAt:  book.UploadedAt,
+		}
+		added = []models.BookVersion{first, version}
+	}
+
+	set := bson.M{
+		"version":      version.Version,
+		"content_hash": version.ContentHash,
+		"total_chunks": version.TotalChunks,
+		"total_chars":  version.TotalChars,
+		"chapters":     version.Chapters,
+		"updated_at":   time.Now(),
+	}
+	if book.OriginalBookID == "" {
+		set["canonical_hash"] = version.ContentHash
+	}
+	update := bson.M{
+		"$set":   set,
+		"$push":  bson.M{"versions": bson.M{"$each": added}},
+		"$unset": bson.M{"pending_version": ""},
+	}
+	result, err := s.books.UpdateOne(ctx, bson.M{"_id": book.ID, "pending_version": version.Version}, update)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateBook
+		}
+		return fmt.Errorf("failed to update book version: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("version %d of book %s is no longer claimed", version.Version, book.ID)
+	}
+
+	// cached summaries cover chunk ranges of the old text
+	return s.DeleteSummaries(ctx, book.ID)
+}
+
+// AbortVersion removes what an unfinished version wrote and releases the claim on the book
+func (s *MongoStore) AbortVersion(ctx context.Context, bookID string, version int) error {
+	filter := bson.M{"book_id": bookID, "versions": version}
+	if _, err := s.collection.UpdateMany(ctx, filter, bson.M{"$pull": bson.M{"versions": version}}); err != nil {
+		return fmt.Errorf("failed to remove version from chunks: %w", err)
+	}
+	if _, err := s.collection.DeleteMany(ctx, bson.M{"book_id": bookID, "versions": bson.M{"$size": 0}}); err != nil {
+		return fmt.Errorf("failed to delete chunks of version: %w", err)
+	}
+
+	release := bson.M{"$unset": bson.M{"pending_version": ""}}
+	if _, err := s.books.UpdateOne(ctx, bson.M{"_id": bookID, "pending_version": version}, release); err != nil {
+		return fmt.Errorf("failed to clear pending version: %w", err)
+	}
+	return nil
+}
+
+// DeleteVersion garbage-collects an old version of a book
+// chunks shared with other versions are kept, returns the number of chunks deleted
+func (s *MongoStore) DeleteVersion(ctx context.Context, bookID string, version int) (int64, error) {
+	filter := bson.M{"book_id": bookID, "versions": version}
+	if _, err := s.collection.UpdateMany(ctx, filter, bson.M{"$pull": bson.M{"versions": version}}); err != nil {
+		return 0, fmt.Errorf("failed to remove version from chunks: %w", err)
+	}
+
+	orphaned := bson.M{"book_id": bookID, "versions": bson.M{"$size": 0}}
+	result, err := s.collection.DeleteMany(ctx, orphaned)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete chunks: %w", err)
+	}
+
+	update := bson.M{
+		"$pull": bson.M{"versions": bson.M{"version": version}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	if _, err := s.books.UpdateOne(ctx, bson.M{"_id": bookID}, update); err != nil {
+		return 0, fmt.Errorf("failed to remove version from book: %w", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// GetVersionChunks returns the chunks of the current version of a book in chunk order, to match a new version against
+// embeddings are left out, and the text is only loaded for chunks stored before their hash was recorded
+func (s *MongoStore) GetVersionChunks(ctx context.Context, bookID string) ([]models.Chunk, error) {
+	filter, err := s.visibleChunks(ctx, []string{bookID}, 0)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "chunk_index", Value: 1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$unset", Value: bson.A{"embedding", "embedding_next"}}},
+		bson.D{{Key: "$set", Value: bson.M{
+			"text": bson.M{"$cond": bson.A{bson.M{"$ifNull": bson.A{"$content_hash", false}}, "$$REMOVE", "$text"}},
+		}}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find chunks: %w", err)
+	}
+	var chunks []models.Chunk
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, fmt.Errorf("failed to decode chunks: %w", err)
+	}
+	return chunks, nil
+}
+
+// GetEmbeddings returns chunks by ID with only their embedding, model and dimension, keyed by ID
+func (s *MongoStore) GetEmbeddings(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]models.Chunk, error) {
+	chunks := make(map[primitive.ObjectID]models.Chunk, len(ids))
+	if len(ids) == 0 {
+		return chunks, nil
+	}
+	opts := options.Find().SetProjection(bson.M{"embedding": 1, "embedding_model": 1, "embedding_dim": 1})
+	cursor, err := s.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find embeddings: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var chunk models.Chunk
+		if err := cursor.Decode(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		chunks[chunk.ID] = chunk
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %w", err)
+	}
+	return chunks, nil
+}